@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/gookit/color"
+	"github.com/rs/zerolog/log"
+)
+
+// BearerTokenFile returns where the access tokens are found by the tools
+// following the WLCG Bearer Token Discovery: $BEARER_TOKEN_FILE, otherwise
+// bt_u<uid> in $XDG_RUNTIME_DIR or in /tmp.
+func BearerTokenFile() string {
+	if filename := os.Getenv("BEARER_TOKEN_FILE"); filename != "" {
+		return filename
+	}
+
+	name := fmt.Sprintf("bt_u%d", os.Getuid())
+
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, name)
+	}
+
+	// Not os.TempDir: the batch systems point $TMPDIR to the job scratch
+	// directory, where the other tools do not look
+	return filepath.Join("/tmp", name)
+}
+
+// WriteAccessToken replaces the file with the access token, readable by the
+// user only.
+func WriteAccessToken(filename string, accessToken string) error {
+	log.Debug().Str("filename", filename).Msg("token - write")
+
+	err := writeFileAtomic(filename, []byte(accessToken+"\n"), 0600)
+	if err != nil {
+		return fmt.Errorf("write token %w", err)
+	}
+
+	return nil
+}
+
+// tokenOutput is where the operations write the access tokens they obtain:
+// a given file or the WLCG bearer token location.
+type tokenOutput struct {
+	file   string
+	bearer bool
+}
+
+func (o *tokenOutput) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.file, "o", "", "write the access token to this file")
+	flags.BoolVar(&o.bearer, "bearer", false, "write the access token where the WLCG bearer token discovery finds it")
+}
+
+// write writes the access token when a destination was chosen and tells
+// whether it did.
+func (o *tokenOutput) write(accessToken string) (bool, error) {
+	filename := o.file
+	if filename == "" && o.bearer {
+		filename = BearerTokenFile()
+	}
+
+	if filename == "" {
+		return false, nil
+	}
+
+	err := WriteAccessToken(filename, accessToken)
+	if err != nil {
+		return false, err
+	}
+
+	color.Green.Printf("==> Access token written to %s\n", filename)
+
+	return true, nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gookit/color"
+)
+
+// WLCGAnyAudience is the audience of the WLCG tokens accepted by any service.
+const WLCGAnyAudience = "https://wlcg.cern.ch/jwt/v1/any"
+
+var (
+	errTokenVerification = errors.New("token verification failed")
+)
+
+// TokenCheck is the result of one of the checks of a token.
+type TokenCheck struct {
+	Claim   string
+	Passed  bool
+	Message string
+}
+
+// FetchJWKS gets the key set published by the provider at its jwks_uri.
+func (t *InitClientConfig) FetchJWKS(provider *ProviderMetadata) ([]JWK, error) {
+	jwksURI, err := requireEndpoint("jwks_uri", provider.JwksURI)
+	if err != nil {
+		return nil, err
+	}
+
+	// The key set is not cached, to pick up the rotated keys
+	status, body, err := fetchDocument(&t.HTTPClient, "", jwksURI)
+	if err != nil {
+		return nil, err
+	}
+
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s returned %d %s", errHTTP, jwksURI, status, http.StatusText(status))
+	}
+
+	var jwks struct {
+		Keys []JWK `json:"keys"`
+	}
+
+	err = json.Unmarshal(body, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid key set: %s", errHTTP, err)
+	}
+
+	return jwks.Keys, nil
+}
+
+// numericDate returns the time of a NumericDate claim (RFC 7519, section 2).
+func numericDate(claims map[string]interface{}, name string) (date time.Time, ok bool) {
+	value, ok := claims[name].(json.Number)
+	if !ok {
+		return date, false
+	}
+
+	seconds, err := value.Float64()
+	if err != nil {
+		return date, false
+	}
+
+	return time.Unix(int64(seconds), 0), true
+}
+
+// audiences returns the aud claim, a string or an array of strings.
+func audiences(claims map[string]interface{}) []string {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		var values []string
+
+		for _, value := range aud {
+			if value, ok := value.(string); ok {
+				values = append(values, value)
+			}
+		}
+
+		return values
+	default:
+		return nil
+	}
+}
+
+// checkWLCGClaims checks the claims of the WLCG Common JWT Profiles.
+func checkWLCGClaims(claims map[string]interface{}) []TokenCheck {
+	version, ok := claims["wlcg.ver"].(string)
+	if !ok {
+		return []TokenCheck{{"wlcg.ver", true, "not a WLCG profile token"}}
+	}
+
+	checks := []TokenCheck{{"wlcg.ver", version == "1.0", fmt.Sprintf("version %q", version)}}
+
+	var missing []string
+
+	for _, name := range []string{"sub", "exp", "iat", "jti"} {
+		if _, ok := claims[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		checks = append(checks, TokenCheck{"wlcg", false, "missing claims " + strings.Join(missing, " ")})
+	}
+
+	if scope, ok := claims["scope"]; ok {
+		_, isString := scope.(string)
+		checks = append(checks, TokenCheck{"scope", isString, fmt.Sprintf("%v", scope)})
+	}
+
+	if groups, ok := claims["wlcg.groups"]; ok {
+		list, valid := groups.([]interface{})
+
+		for _, group := range list {
+			if group, ok := group.(string); !ok || !strings.HasPrefix(group, "/") {
+				valid = false
+			}
+		}
+
+		checks = append(checks, TokenCheck{"wlcg.groups", valid, fmt.Sprintf("%v", groups)})
+	}
+
+	if _, hasScope := claims["scope"]; !hasScope {
+		if _, hasGroups := claims["wlcg.groups"]; !hasGroups {
+			checks = append(checks, TokenCheck{"wlcg", false, "neither scope nor wlcg.groups authorize the token"})
+		}
+	}
+
+	return checks
+}
+
+// CheckToken verifies the signature of the token with the key set of the
+// provider of the stored client and checks its iss, aud, exp, nbf and WLCG
+// profile claims. The audience, when not empty, must be in the aud claim.
+func (t *InitClientConfig) CheckToken(instance string, token string, audience string) (header map[string]interface{}, claims map[string]interface{}, checks []TokenCheck, err error) { //nolint:lll
+	header, claims, err = DecodeJWT(token)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	clientResponse, _, err := t.LoadClient(instance)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	provider, err := t.Discover(clientResponse.IssuerEndpoint())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	keys, err := t.FetchJWKS(provider)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if jwk, errVerify := VerifyJWT(token, keys); errVerify != nil {
+		checks = append(checks, TokenCheck{"signature", false, errVerify.Error()})
+	} else {
+		checks = append(checks, TokenCheck{"signature", true, fmt.Sprintf("%s, key %s", header["alg"], jwk.Kid)})
+	}
+
+	issuer, _ := claims["iss"].(string)
+	checks = append(checks, TokenCheck{"iss", issuer == provider.Issuer, issuer})
+
+	now := time.Now()
+
+	if exp, ok := numericDate(claims, "exp"); !ok {
+		checks = append(checks, TokenCheck{"exp", false, "missing"})
+	} else if now.Before(exp) {
+		checks = append(checks, TokenCheck{"exp", true, fmt.Sprintf("expires %s, in %s", exp, exp.Sub(now).Round(time.Second))})
+	} else {
+		checks = append(checks, TokenCheck{"exp", false, fmt.Sprintf("expired %s, %s ago", exp, now.Sub(exp).Round(time.Second))})
+	}
+
+	if nbf, ok := numericDate(claims, "nbf"); ok {
+		checks = append(checks, TokenCheck{"nbf", !now.Before(nbf), fmt.Sprintf("valid from %s", nbf)})
+	}
+
+	aud := audiences(claims)
+
+	switch {
+	case audience == "":
+		checks = append(checks, TokenCheck{"aud", true, strings.Join(aud, " ")})
+	case contains(aud, audience) || contains(aud, WLCGAnyAudience):
+		checks = append(checks, TokenCheck{"aud", true, fmt.Sprintf("%s accepted", audience)})
+	default:
+		checks = append(checks, TokenCheck{"aud", false, fmt.Sprintf("%s not in %s", audience, strings.Join(aud, " "))})
+	}
+
+	checks = append(checks, checkWLCGClaims(claims)...)
+
+	return header, claims, checks, nil
+}
+
+func decodeOperation(clientIAM *InitClientConfig, instance string, args []string) error {
+	flags := flag.NewFlagSet("decode", flag.ContinueOnError)
+	audience := flags.String("audience", "", "audience the token must be valid for")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	token, err := tokenArgument(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	header, claims, checks, err := clientIAM.CheckToken(instance, token, *audience)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range []struct {
+		name  string
+		value map[string]interface{}
+	}{
+		{"Header", header},
+		{"Claims", claims},
+	} {
+		var out bytes.Buffer
+
+		encoder := json.NewEncoder(&out)
+		encoder.SetIndent("", "  ")
+
+		err = encoder.Encode(part.value)
+		if err != nil {
+			return fmt.Errorf("decode token %w", err)
+		}
+
+		color.Green.Printf("==> %s:\n", part.name)
+		fmt.Print(out.String())
+	}
+
+	color.Green.Println("==> Checks:")
+
+	failed := 0
+
+	for _, check := range checks {
+		if check.Passed {
+			fmt.Printf("%s %s: %s\n", color.Green.Sprint("[OK]"), check.Claim, check.Message)
+		} else {
+			fmt.Printf("%s %s: %s\n", color.Red.Sprint("[X]"), check.Claim, check.Message)
+
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%w: %d checks failed", errTokenVerification, failed)
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// testProvider serves the discovery document and the key set of keys.
+func testProvider(t *testing.T, keys testKeys) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(ProviderMetadata{
+			Issuer:        server.URL + "/",
+			TokenEndpoint: server.URL + "/token",
+			JwksURI:       server.URL + "/jwk",
+		})
+	})
+
+	mux.HandleFunc("/jwk", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string][]JWK{"keys": keys.jwks})
+	})
+
+	return server
+}
+
+func TestCheckToken(t *testing.T) {
+	keys := newTestKeys(t)
+	server := testProvider(t, keys)
+
+	dir, err := ioutil.TempDir("", "iamclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	clientIAM := &InitClientConfig{
+		HTTPClient: *server.Client(),
+		Store:      FileStore{Dir: dir},
+	}
+
+	err = clientIAM.Store.Save("instance", []byte(`{"client_id":"id","issuer":"`+server.URL+`/"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	valid := func(changes map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"iss": server.URL + "/",
+			"sub": "user",
+			"aud": []string{"https://storage.example", "https://compute.example"},
+			"iat": now.Unix(),
+			"nbf": now.Add(-time.Minute).Unix(),
+			"exp": now.Add(time.Hour).Unix(),
+		}
+
+		for name, value := range changes {
+			claims[name] = value
+		}
+
+		return claims
+	}
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "rsa"}
+
+	tests := map[string]struct {
+		token    string
+		audience string
+		failed   []string
+	}{
+		"valid":   {signToken(t, keys.rsa, rs256, valid(nil)), "", nil},
+		"PS256":   {signToken(t, keys.rsa, map[string]interface{}{"alg": "PS256", "kid": "rsa"}, valid(nil)), "", nil},
+		"ES256":   {signToken(t, keys.p256, map[string]interface{}{"alg": "ES256", "kid": "p256"}, valid(nil)), "", nil},
+		"expired": {signToken(t, keys.rsa, rs256, valid(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})), "", []string{"exp"}},
+		"no exp":  {signToken(t, keys.rsa, rs256, valid(map[string]interface{}{"exp": nil})), "", []string{"exp"}},
+		"not yet valid": {
+			signToken(t, keys.rsa, rs256, valid(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})), "", []string{"nbf"},
+		},
+		"other issuer": {
+			signToken(t, keys.rsa, rs256, valid(map[string]interface{}{"iss": "https://iam.example/"})), "", []string{"iss"},
+		},
+		"audience":       {signToken(t, keys.rsa, rs256, valid(nil)), "https://compute.example", nil},
+		"wrong audience": {signToken(t, keys.rsa, rs256, valid(nil)), "https://other.example", []string{"aud"}},
+		"string audience": {
+			signToken(t, keys.rsa, rs256, valid(map[string]interface{}{"aud": "https://compute.example"})), "https://compute.example", nil,
+		},
+		"any audience": {
+			signToken(t, keys.rsa, rs256, valid(map[string]interface{}{"aud": WLCGAnyAudience})), "https://other.example", nil,
+		},
+		"alg none":  {signToken(t, nil, map[string]interface{}{"alg": "none"}, valid(nil)), "", []string{"signature"}},
+		"HS256":     {signToken(t, nil, map[string]interface{}{"alg": "HS256", "kid": "rsa"}, valid(nil)), "", []string{"signature"}},
+		"wrong kid": {signToken(t, keys.rsa, map[string]interface{}{"alg": "RS256", "kid": "p256"}, valid(nil)), "", []string{"signature"}},
+	}
+
+	for name, test := range tests {
+		_, _, checks, err := clientIAM.CheckToken("instance", test.token, test.audience)
+		if err != nil {
+			t.Errorf("%s: CheckToken error %v", name, err)
+
+			continue
+		}
+
+		var failed []string
+
+		for _, check := range checks {
+			if !check.Passed {
+				failed = append(failed, check.Claim)
+			}
+		}
+
+		if len(failed) != len(test.failed) || (len(failed) > 0 && failed[0] != test.failed[0]) {
+			t.Errorf("%s: failed checks %v, want %v (%+v)", name, failed, test.failed, checks)
+		}
+	}
+}
+
+func TestCheckWLCGClaims(t *testing.T) {
+	tests := map[string]struct {
+		claims map[string]interface{}
+		failed int
+	}{
+		"not WLCG": {map[string]interface{}{"sub": "user"}, 0},
+		"valid": {map[string]interface{}{
+			"wlcg.ver": "1.0", "sub": "user", "exp": 1, "iat": 1, "jti": "id", "scope": "storage.read:/",
+		}, 0},
+		"groups": {map[string]interface{}{
+			"wlcg.ver": "1.0", "sub": "user", "exp": 1, "iat": 1, "jti": "id", "wlcg.groups": []interface{}{"/cms"},
+		}, 0},
+		"bad version":    {map[string]interface{}{"wlcg.ver": "2.0", "sub": "user", "exp": 1, "iat": 1, "jti": "id", "scope": "x"}, 1},
+		"missing claims": {map[string]interface{}{"wlcg.ver": "1.0", "scope": "x"}, 1},
+		"bad groups": {map[string]interface{}{
+			"wlcg.ver": "1.0", "sub": "user", "exp": 1, "iat": 1, "jti": "id", "wlcg.groups": []interface{}{"cms"},
+		}, 1},
+		"no authorization": {map[string]interface{}{"wlcg.ver": "1.0", "sub": "user", "exp": 1, "iat": 1, "jti": "id"}, 1},
+	}
+
+	for name, test := range tests {
+		failed := 0
+
+		for _, check := range checkWLCGClaims(test.claims) {
+			if !check.Passed {
+				failed++
+			}
+		}
+
+		if failed != test.failed {
+			t.Errorf("%s: %d failed checks, want %d", name, failed, test.failed)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gookit/color"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	errDeviceCodeExpired = errors.New("the device code expired before the authorization")
+)
+
+// DeviceAuthorization is the response of the device authorization endpoint
+// (RFC 8628, section 3.2).
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval,omitempty"`
+}
+
+// DeviceLogin obtains a refresh token for the stored client with the device
+// authorization grant (RFC 8628), for nodes without a browser, and stores it
+// with the client.
+func (t *InitClientConfig) DeviceLogin(instance string) (token TokenResponse, err error) {
+	clientResponse, passwd, err := t.LoadClient(instance)
+	if err != nil {
+		return token, err
+	}
+
+	provider, err := t.Discover(clientResponse.IssuerEndpoint())
+	if err != nil {
+		return token, err
+	}
+
+	deviceEndpoint, err := requireEndpoint("device_authorization_endpoint", provider.DeviceAuthorizationEndpoint)
+	if err != nil {
+		return token, err
+	}
+
+	tokenEndpoint, err := requireEndpoint("token_endpoint", provider.TokenEndpoint)
+	if err != nil {
+		return token, err
+	}
+
+	form := url.Values{}
+	if clientResponse.Scope != "" {
+		form.Set("scope", clientResponse.Scope)
+	}
+
+	status, body, err := t.postForm(deviceEndpoint, tokenEndpoint, clientResponse, form)
+	if err != nil {
+		return token, err
+	}
+
+	if status != http.StatusOK {
+		return token, tokenError(status, body)
+	}
+
+	var device DeviceAuthorization
+
+	err = json.Unmarshal(body, &device)
+	if err != nil {
+		return token, fmt.Errorf("%w: invalid device authorization response: %s", errHTTP, err)
+	}
+
+	// device_code and expires_in are required (RFC 8628, section 3.2), the
+	// polling would never end without the latter
+	if device.DeviceCode == "" || device.ExpiresIn <= 0 {
+		return token, fmt.Errorf("%w: invalid device authorization response: no device_code or expires_in", errHTTP)
+	}
+
+	color.Green.Printf("==> To log in, visit %s and enter the code: %s\n", device.VerificationURI, device.UserCode)
+
+	if device.VerificationURIComplete != "" {
+		color.Green.Printf("==> or open directly: %s\n", device.VerificationURIComplete)
+	}
+
+	// The default polling interval is 5 seconds (RFC 8628, section 3.2)
+	interval := 5 * time.Second
+	if device.Interval > 0 {
+		interval = time.Duration(device.Interval) * time.Second
+	}
+
+	expiresIn := time.Duration(device.ExpiresIn) * time.Second
+
+	token, err = pollDeviceToken(interval, expiresIn, realClock{}, func() (TokenResponse, error) {
+		return t.TokenRequest(tokenEndpoint, clientResponse, url.Values{
+			"grant_type":  {GrantDeviceCode},
+			"device_code": {device.DeviceCode},
+		})
+	})
+	if err != nil {
+		return token, err
+	}
+
+	_, err = t.storeTokens(instance, clientResponse, passwd, token)
+
+	return token, err
+}
+
+// clock is the time source of the device polling.
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// pollDeviceToken requests the token every interval while the authorization
+// is pending, slowing down when asked to, until the device code expires.
+func pollDeviceToken(interval time.Duration, expiresIn time.Duration, clock clock, request func() (TokenResponse, error)) (TokenResponse, error) { //nolint:lll
+	deadline := clock.Now().Add(expiresIn)
+
+	for clock.Now().Before(deadline) {
+		clock.Sleep(interval)
+
+		token, err := request()
+
+		var oauthErr *OAuthError
+
+		switch {
+		case err == nil:
+			return token, nil
+		case errors.As(err, &oauthErr) && oauthErr.Code == "authorization_pending":
+			log.Debug().Msg("device - authorization pending")
+		case errors.As(err, &oauthErr) && oauthErr.Code == "slow_down":
+			// Increase the interval of 5 seconds for this and the next
+			// requests (RFC 8628, section 3.5)
+			interval += 5 * time.Second
+
+			log.Debug().Dur("interval", interval).Msg("device - slow down")
+		default:
+			return token, err
+		}
+	}
+
+	return TokenResponse{}, errDeviceCodeExpired
+}
+
+func deviceOperation(clientIAM *InitClientConfig, instance string, args []string) error {
+	var output tokenOutput
+
+	flags := flag.NewFlagSet("device", flag.ContinueOnError)
+	output.register(flags)
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() > 0 {
+		return fmt.Errorf("%w: %s", errTooManyArgs, strings.Join(flags.Args(), " "))
+	}
+
+	token, err := clientIAM.DeviceLogin(instance)
+	if err != nil {
+		return err
+	}
+
+	clientIAM.warnRefreshToken(instance, token)
+
+	color.Green.Printf("==> Client %s logged in\n", instance)
+
+	_, err = output.write(token.AccessToken)
+
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeClock advances only when sleeping, recording the sleeps.
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+}
+
+func TestPollDeviceToken(t *testing.T) {
+	pending := &OAuthError{Code: "authorization_pending"}
+	slowDown := &OAuthError{Code: "slow_down"}
+	denied := &OAuthError{Code: "access_denied"}
+
+	tests := map[string]struct {
+		expiresIn time.Duration
+		responses []error
+		sleeps    []time.Duration
+		err       error
+	}{
+		"immediate": {time.Minute, []error{nil}, []time.Duration{5 * time.Second}, nil},
+		"pending": {
+			time.Minute, []error{pending, pending, nil},
+			[]time.Duration{5 * time.Second, 5 * time.Second, 5 * time.Second}, nil,
+		},
+		"slow down": {
+			time.Minute, []error{pending, slowDown, pending, slowDown, nil},
+			[]time.Duration{5 * time.Second, 5 * time.Second, 10 * time.Second, 10 * time.Second, 15 * time.Second}, nil,
+		},
+		"denied": {time.Minute, []error{pending, denied}, []time.Duration{5 * time.Second, 5 * time.Second}, denied},
+		"expired": {
+			20 * time.Second, []error{pending, pending, pending, pending, pending},
+			[]time.Duration{5 * time.Second, 5 * time.Second, 5 * time.Second, 5 * time.Second}, errDeviceCodeExpired,
+		},
+	}
+
+	for name, test := range tests {
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		requests := 0
+
+		token, err := pollDeviceToken(5*time.Second, test.expiresIn, clock, func() (TokenResponse, error) {
+			response := test.responses[requests]
+			requests++
+
+			if response != nil {
+				return TokenResponse{}, response
+			}
+
+			return TokenResponse{AccessToken: "at"}, nil
+		})
+
+		switch {
+		case test.err == nil && (err != nil || token.AccessToken != "at"):
+			t.Errorf("%s: pollDeviceToken = %+v, %v", name, token, err)
+		case test.err != nil && !errors.Is(err, test.err):
+			t.Errorf("%s: pollDeviceToken error %v, want %v", name, err, test.err)
+		}
+
+		if !reflect.DeepEqual(clock.sleeps, test.sleeps) {
+			t.Errorf("%s: slept %v, want %v", name, clock.sleeps, test.sleeps)
+		}
+	}
+}
+
+func TestDeviceLoginRejectsMissingExpiry(t *testing.T) {
+	mux := http.NewServeMux()
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(ProviderMetadata{
+			Issuer:                      server.URL + "/",
+			TokenEndpoint:               server.URL + "/token",
+			DeviceAuthorizationEndpoint: server.URL + "/devicecode",
+		})
+	})
+
+	mux.HandleFunc("/devicecode", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(DeviceAuthorization{
+			DeviceCode:      "device",
+			UserCode:        "ABCD-EFGH",
+			VerificationURI: server.URL + "/device",
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("token requested without a device code expiry")
+		w.WriteHeader(http.StatusBadRequest)
+	})
+
+	dir, err := ioutil.TempDir("", "iamclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	clientIAM := &InitClientConfig{
+		HTTPClient: *server.Client(),
+		Store:      FileStore{Dir: dir},
+	}
+
+	err = clientIAM.Store.Save("instance", []byte(`{"client_id":"id","issuer":"`+server.URL+`/"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = clientIAM.DeviceLogin("instance")
+	if !errors.Is(err, errHTTP) {
+		t.Errorf("DeviceLogin error %v, want %v", err, errHTTP)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	errIssuerMismatch        = errors.New("the discovered issuer does not match the requested one")
+	errEndpointNotDiscovered = errors.New("endpoint not advertised by the provider")
+)
+
+// ProviderMetadata is the OpenID Provider configuration (OpenID Connect
+// Discovery 1.0, section 3), with the endpoints of the OAuth extensions
+// supported by IAM.
+type ProviderMetadata struct {
+	Issuer                                 string   `json:"issuer"`
+	AuthorizationEndpoint                  string   `json:"authorization_endpoint"`
+	TokenEndpoint                          string   `json:"token_endpoint"`
+	UserinfoEndpoint                       string   `json:"userinfo_endpoint,omitempty"`
+	JwksURI                                string   `json:"jwks_uri"`
+	RegistrationEndpoint                   string   `json:"registration_endpoint,omitempty"`
+	DeviceAuthorizationEndpoint            string   `json:"device_authorization_endpoint,omitempty"`
+	IntrospectionEndpoint                  string   `json:"introspection_endpoint,omitempty"`
+	RevocationEndpoint                     string   `json:"revocation_endpoint,omitempty"`
+	EndSessionEndpoint                     string   `json:"end_session_endpoint,omitempty"`
+	ScopesSupported                        []string `json:"scopes_supported,omitempty"`
+	ResponseTypesSupported                 []string `json:"response_types_supported,omitempty"`
+	GrantTypesSupported                    []string `json:"grant_types_supported,omitempty"`
+	TokenEndpointAuthMethodsSupported      []string `json:"token_endpoint_auth_methods_supported,omitempty"`
+	TokenEndpointAuthSigningAlgsSupported  []string `json:"token_endpoint_auth_signing_alg_values_supported,omitempty"`
+	CodeChallengeMethodsSupported          []string `json:"code_challenge_methods_supported,omitempty"`
+	SubjectTypesSupported                  []string `json:"subject_types_supported,omitempty"`
+	IDTokenSigningAlgValuesSupported       []string `json:"id_token_signing_alg_values_supported,omitempty"`
+	ClaimsSupported                        []string `json:"claims_supported,omitempty"`
+	IntrospectionEndpointAuthMethods       []string `json:"introspection_endpoint_auth_methods_supported,omitempty"`
+	RevocationEndpointAuthMethodsSupported []string `json:"revocation_endpoint_auth_methods_supported,omitempty"`
+}
+
+// requireEndpoint returns the named endpoint value, failing when the
+// provider does not advertise it.
+func requireEndpoint(name string, value string) (string, error) {
+	if value == "" {
+		return "", fmt.Errorf("%w: %s", errEndpointNotDiscovered, name)
+	}
+
+	return value, nil
+}
+
+// AssertionAudience is the aud of the private_key_jwt client assertions:
+// the token endpoint, the one IAM accepts at the introspection, revocation
+// and device endpoints too, or the issuer without it.
+func (p *ProviderMetadata) AssertionAudience() string {
+	if p.TokenEndpoint != "" {
+		return p.TokenEndpoint
+	}
+
+	return p.Issuer
+}
+
+// discoveryCache is a discovery document stored on disk, with the HTTP
+// caching information needed to reuse it.
+type discoveryCache struct {
+	URL     string          `json:"url"`
+	ETag    string          `json:"etag,omitempty"`
+	Expires time.Time       `json:"expires"`
+	Body    json.RawMessage `json:"body"`
+}
+
+func cacheFile(cacheDir string, url string) string {
+	sum := sha256.Sum256([]byte(url))
+
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:])+".json")
+}
+
+func loadDiscoveryCache(cacheDir string, url string) (cache discoveryCache, ok bool) {
+	if cacheDir == "" {
+		return cache, false
+	}
+
+	content, err := ioutil.ReadFile(cacheFile(cacheDir, url))
+	if err != nil {
+		return cache, false
+	}
+
+	if json.Unmarshal(content, &cache) != nil || cache.URL != url {
+		return cache, false
+	}
+
+	return cache, true
+}
+
+func storeDiscoveryCache(cacheDir string, cache discoveryCache) {
+	if cacheDir == "" {
+		return
+	}
+
+	content, err := json.Marshal(cache)
+	if err == nil {
+		err = os.MkdirAll(cacheDir, 0700)
+	}
+
+	if err == nil {
+		err = ioutil.WriteFile(cacheFile(cacheDir, cache.URL), content, 0600)
+	}
+
+	if err != nil {
+		log.Debug().Err(err).Str("URL", cache.URL).Msg("discovery - cannot store cache")
+	}
+}
+
+// cacheExpiration returns until when a response can be reused without
+// revalidation, and whether it can be stored at all.
+func cacheExpiration(header http.Header, now time.Time) (expires time.Time, store bool) {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+
+		switch {
+		case directive == "no-store":
+			return now, false
+		case directive == "no-cache":
+			return now, true
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err == nil {
+				return now.Add(time.Duration(seconds) * time.Second), true
+			}
+		}
+	}
+
+	if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		return expires, true
+	}
+
+	return now, true
+}
+
+// fetchDocument gets a discovery document, reusing the cached copy while
+// fresh and revalidating it with its ETag afterwards.
+func fetchDocument(client *http.Client, cacheDir string, url string) (status int, body []byte, err error) {
+	now := time.Now()
+
+	cache, cached := loadDiscoveryCache(cacheDir, url)
+	if cached && now.Before(cache.Expires) {
+		log.Debug().Str("URL", url).Time("expires", cache.Expires).Msg("discovery - cached")
+
+		return http.StatusOK, cache.Body, nil
+	}
+
+	log.Debug().Str("URL", url).Msg("discovery")
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("discovery %w", err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	if cached && cache.ETag != "" {
+		req.Header.Set("If-None-Match", cache.ETag)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %s", errHTTP, err)
+	}
+
+	defer resp.Body.Close()
+
+	var buff bytes.Buffer
+
+	_, err = buff.ReadFrom(resp.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %s", errHTTP, err)
+	}
+
+	log.Debug().Int("StatusCode", resp.StatusCode).Str("Status", resp.Status).Msg("discovery")
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if !cached {
+			return resp.StatusCode, nil, fmt.Errorf("%w: %s returned %s", errHTTP, url, resp.Status)
+		}
+
+		cache.Expires, _ = cacheExpiration(resp.Header, now)
+		storeDiscoveryCache(cacheDir, cache)
+
+		return http.StatusOK, cache.Body, nil
+	case http.StatusOK:
+		expires, store := cacheExpiration(resp.Header, now)
+		if store && json.Valid(buff.Bytes()) {
+			storeDiscoveryCache(cacheDir, discoveryCache{
+				URL:     url,
+				ETag:    resp.Header.Get("ETag"),
+				Expires: expires,
+				Body:    buff.Bytes(),
+			})
+		}
+	}
+
+	return resp.StatusCode, buff.Bytes(), nil
+}
+
+// wellKnownURLs returns the OpenID Connect discovery URL of the issuer and
+// the RFC 8414 authorization server metadata one, where the well-known path
+// is inserted before the issuer path.
+func wellKnownURLs(issuer string) ([]string, error) {
+	uri, err := url.Parse(strings.TrimSuffix(issuer, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("discovery %w", err)
+	}
+
+	oidc := uri.String() + "/.well-known/openid-configuration"
+
+	uri.Path = "/.well-known/oauth-authorization-server" + uri.Path
+
+	return []string{oidc, uri.String()}, nil
+}
+
+// Discover fetches the OpenID Provider configuration of the issuer, or its
+// RFC 8414 authorization server metadata when the former is missing, and
+// checks that it belongs to the issuer itself. Documents are cached in
+// cacheDir, if not empty, as allowed by their Cache-Control and ETag.
+func Discover(client *http.Client, cacheDir string, issuer string) (*ProviderMetadata, error) {
+	urls, err := wellKnownURLs(issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		wellKnown string
+		status    int
+		body      []byte
+	)
+
+	for _, wellKnown = range urls {
+		status, body, err = fetchDocument(client, cacheDir, wellKnown)
+		if err != nil {
+			return nil, err
+		}
+
+		if status != http.StatusNotFound {
+			break
+		}
+	}
+
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s returned %d %s", errHTTP, wellKnown, status, http.StatusText(status))
+	}
+
+	var metadata ProviderMetadata
+
+	err = json.Unmarshal(body, &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid %s: %s", errHTTP, wellKnown, err)
+	}
+
+	// IAM advertises its issuer with a trailing slash
+	if strings.TrimSuffix(metadata.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("%w: requested %q, got %q", errIssuerMismatch, issuer, metadata.Issuer)
+	}
+
+	log.Debug().Str("issuer", metadata.Issuer).Str("URL", wellKnown).Msg("discovery")
+
+	return &metadata, nil
+}
+
+// Discover fetches the provider metadata of the issuer with the configured
+// HTTP client and discovery cache.
+func (t *InitClientConfig) Discover(issuer string) (*ProviderMetadata, error) {
+	return Discover(&t.HTTPClient, t.CacheDir, issuer)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheExpiration(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		header  http.Header
+		expires time.Time
+		store   bool
+	}{
+		"no header":  {http.Header{}, now, true},
+		"max-age":    {http.Header{"Cache-Control": {"public, max-age=3600"}}, now.Add(time.Hour), true},
+		"upper case": {http.Header{"Cache-Control": {"Max-Age=60"}}, now.Add(time.Minute), true},
+		"no-cache":   {http.Header{"Cache-Control": {"no-cache, max-age=3600"}}, now, true},
+		"no-store":   {http.Header{"Cache-Control": {"no-store"}}, now, false},
+		"bad max-age": {
+			http.Header{"Cache-Control": {"max-age=soon"}, "Expires": {"Mon, 01 Jun 2020 13:00:00 GMT"}},
+			now.Add(time.Hour), true,
+		},
+		"expires":     {http.Header{"Expires": {"Mon, 01 Jun 2020 14:00:00 GMT"}}, now.Add(2 * time.Hour), true},
+		"bad expires": {http.Header{"Expires": {"0"}}, now, true},
+		"max-age over expires": {
+			http.Header{"Cache-Control": {"max-age=60"}, "Expires": {"Mon, 01 Jun 2020 14:00:00 GMT"}},
+			now.Add(time.Minute), true,
+		},
+	}
+
+	for name, test := range tests {
+		expires, store := cacheExpiration(test.header, now)
+		if !expires.Equal(test.expires) || store != test.store {
+			t.Errorf("%s: cacheExpiration = %s, %v, want %s, %v", name, expires, store, test.expires, test.store)
+		}
+	}
+}
+
+// fakeDiscovery serves a discovery document with an ETag, counting the
+// requests and the revalidations.
+type fakeDiscovery struct {
+	sync.Mutex
+	cacheControl  string
+	issuer        string
+	requests      int
+	revalidations int
+}
+
+func (f *fakeDiscovery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if r.URL.Path != "/.well-known/openid-configuration" {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	f.requests++
+
+	w.Header().Set("Cache-Control", f.cacheControl)
+	w.Header().Set("ETag", `"v1"`)
+
+	if r.Header.Get("If-None-Match") == `"v1"` {
+		f.revalidations++
+
+		w.WriteHeader(http.StatusNotModified)
+
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(ProviderMetadata{Issuer: f.issuer, TokenEndpoint: f.issuer + "/token"})
+}
+
+func TestDiscoverCache(t *testing.T) {
+	fake := &fakeDiscovery{}
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	fake.issuer = server.URL
+
+	cacheDir, err := ioutil.TempDir("", "iamclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(cacheDir)
+
+	discover := func() {
+		t.Helper()
+
+		provider, err := Discover(server.Client(), cacheDir, server.URL)
+		if err != nil || provider.TokenEndpoint != server.URL+"/token" {
+			t.Fatalf("Discover = %+v, %v", provider, err)
+		}
+	}
+
+	for _, step := range []struct {
+		cacheControl  string
+		expire        bool
+		requests      int
+		revalidations int
+	}{
+		{"max-age=3600", false, 1, 0},
+		// fresh, served from the cache
+		{"max-age=3600", false, 1, 0},
+		// stale, revalidated with the ETag
+		{"max-age=3600", true, 2, 1},
+		// fresh again after the revalidation
+		{"max-age=3600", false, 2, 1},
+		{"no-cache", true, 3, 2},
+		// revalidated every time
+		{"no-cache", false, 4, 3},
+	} {
+		if step.expire {
+			cache, ok := loadDiscoveryCache(cacheDir, server.URL+"/.well-known/openid-configuration")
+			if !ok {
+				t.Fatal("discovery document not cached")
+			}
+
+			cache.Expires = time.Now().Add(-time.Second)
+			storeDiscoveryCache(cacheDir, cache)
+		}
+
+		fake.Lock()
+		fake.cacheControl = step.cacheControl
+		fake.Unlock()
+
+		discover()
+
+		fake.Lock()
+		requests, revalidations := fake.requests, fake.revalidations
+		fake.Unlock()
+
+		if requests != step.requests || revalidations != step.revalidations {
+			t.Errorf("%s: %d requests and %d revalidations, want %d and %d",
+				step.cacheControl, requests, revalidations, step.requests, step.revalidations)
+		}
+	}
+}
+
+func TestDiscoverNoStore(t *testing.T) {
+	fake := &fakeDiscovery{cacheControl: "no-store"}
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	fake.issuer = server.URL
+
+	cacheDir, err := ioutil.TempDir("", "iamclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(cacheDir)
+
+	for i := 0; i < 2; i++ {
+		_, err := Discover(server.Client(), cacheDir, server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := loadDiscoveryCache(cacheDir, server.URL+"/.well-known/openid-configuration"); ok || fake.requests != 2 {
+		t.Errorf("no-store document cached, %d requests", fake.requests)
+	}
+}
+
+func TestDiscoverIssuerMismatch(t *testing.T) {
+	fake := &fakeDiscovery{issuer: "https://iam.example"}
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	_, err := Discover(server.Client(), "", server.URL)
+	if !errors.Is(err, errIssuerMismatch) {
+		t.Errorf("Discover error %v, want %v", err, errIssuerMismatch)
+	}
+}
+
+func TestWellKnownURLs(t *testing.T) {
+	urls, err := wellKnownURLs("https://iam.example/realm/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"https://iam.example/realm/.well-known/openid-configuration",
+		"https://iam.example/.well-known/oauth-authorization-server/realm",
+	}
+
+	if len(urls) != 2 || urls[0] != want[0] || urls[1] != want[1] {
+		t.Errorf("wellKnownURLs = %v, want %v", urls, want)
+	}
+}
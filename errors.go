@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+var (
+	errHTTP                        = errors.New("HTTP request failed")
+	errOAuth                       = errors.New("request rejected by the authorization server")
+	errNoEndpoint                  = errors.New("something went wrong, no endpoint selected")
+	errInvalidRedirectURI          = errors.New("invalid redirect uri")
+	errInvalidSoftwareStatement    = errors.New("invalid software statement")
+	errUnapprovedSoftwareStatement = errors.New("unapproved software statement")
+	errInitialAccessTokenMissing   = errors.New("the registration endpoint requires an initial access token")
+	errInitialAccessTokenRejected  = errors.New("the initial access token was rejected, it may be expired or invalid")
+)
+
+// authParam matches the quoted parameters of a WWW-Authenticate challenge.
+var authParam = regexp.MustCompile(`([a-z_]+)="([^"]*)"`)
+
+// Process exit codes, so that scripts can tell the failures apart.
+const (
+	ExitFailure                  = 1
+	ExitHTTP                     = 3
+	ExitInvalidRedirectURI       = 4
+	ExitInvalidClientMetadata    = 5
+	ExitInvalidSoftwareStatement = 6
+	ExitUnauthorized             = 7
+	ExitDiscovery                = 8
+	ExitUnsupportedCapability    = 9
+	ExitOAuth                    = 10
+	ExitTokenVerification        = 11
+)
+
+// registrationErrors are the error codes of RFC 7591, section 3.2.2.
+var registrationErrors = map[string]error{
+	"invalid_redirect_uri":          errInvalidRedirectURI,
+	"invalid_client_metadata":       errInvalidMetadata,
+	"invalid_software_statement":    errInvalidSoftwareStatement,
+	"unapproved_software_statement": errUnapprovedSoftwareStatement,
+}
+
+// RegistrationError is an error response of the client registration or
+// management endpoints (RFC 7591, section 3.2.2).
+type RegistrationError struct {
+	StatusCode  int    `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *RegistrationError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("registration rejected with %s: %s", e.Code, e.Description)
+	}
+
+	return fmt.Sprintf("registration rejected with %s", e.Code)
+}
+
+// Is matches the sentinel error of the RFC 7591 error code, and errHTTP for
+// the unknown ones.
+func (e *RegistrationError) Is(target error) bool {
+	err, ok := registrationErrors[e.Code]
+	if !ok {
+		return target == errHTTP
+	}
+
+	return target == err
+}
+
+// responseError decodes an error response of the registration endpoints,
+// falling back to a plain HTTP error when the body is not an RFC 7591 one.
+func responseError(statusCode int, body []byte) error {
+	regErr := RegistrationError{StatusCode: statusCode}
+
+	if json.Unmarshal(body, &regErr) == nil && regErr.Code != "" {
+		return &regErr
+	}
+
+	return fmt.Errorf("%w: %d %s: %s", errHTTP, statusCode, http.StatusText(statusCode), body)
+}
+
+// OAuthError is an error response of the token endpoint (RFC 6749, section
+// 5.2) and of the other endpoints sharing its format.
+type OAuthError struct {
+	StatusCode  int    `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("%s: %s: %s", errOAuth, e.Code, e.Description)
+	}
+
+	return fmt.Sprintf("%s: %s", errOAuth, e.Code)
+}
+
+// Is matches errOAuth.
+func (e *OAuthError) Is(target error) bool {
+	return target == errOAuth
+}
+
+// tokenError decodes an error response of the token endpoint, falling back
+// to a plain HTTP error when the body is not an OAuth one.
+func tokenError(statusCode int, body []byte) error {
+	oauthErr := OAuthError{StatusCode: statusCode}
+
+	if json.Unmarshal(body, &oauthErr) == nil && oauthErr.Code != "" {
+		return &oauthErr
+	}
+
+	return fmt.Errorf("%w: %d %s: %s", errHTTP, statusCode, http.StatusText(statusCode), body)
+}
+
+// bearerError decodes an error of a resource protected by bearer tokens,
+// sent in the WWW-Authenticate header (RFC 6750, section 3) or as a token
+// endpoint error response.
+func bearerError(statusCode int, authenticate string, body []byte) error {
+	oauthErr := OAuthError{StatusCode: statusCode}
+
+	for _, match := range authParam.FindAllStringSubmatch(authenticate, -1) {
+		switch match[1] {
+		case "error":
+			oauthErr.Code = match[2]
+		case "error_description":
+			oauthErr.Description = match[2]
+		}
+	}
+
+	if oauthErr.Code != "" {
+		return &oauthErr
+	}
+
+	return tokenError(statusCode, body)
+}
+
+// unauthorizedRegistration explains a 401 response of the registration
+// endpoint, with the error description sent by the server if any.
+func unauthorizedRegistration(withToken bool, authenticate string) error {
+	err := errInitialAccessTokenMissing
+	if withToken {
+		err = errInitialAccessTokenRejected
+	}
+
+	if authenticate != "" {
+		return fmt.Errorf("%w (%s)", err, authenticate)
+	}
+
+	return err
+}
+
+// exitCode maps an error to the process exit code.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, errInvalidRedirectURI):
+		return ExitInvalidRedirectURI
+	case errors.Is(err, errInvalidMetadata):
+		return ExitInvalidClientMetadata
+	case errors.Is(err, errInvalidSoftwareStatement), errors.Is(err, errUnapprovedSoftwareStatement):
+		return ExitInvalidSoftwareStatement
+	case errors.Is(err, errInitialAccessTokenMissing), errors.Is(err, errInitialAccessTokenRejected):
+		return ExitUnauthorized
+	case errors.Is(err, errIssuerMismatch), errors.Is(err, errEndpointNotDiscovered):
+		return ExitDiscovery
+	case errors.Is(err, errUnsupportedCapability), errors.Is(err, errCapabilityDowngraded):
+		return ExitUnsupportedCapability
+	case errors.Is(err, errOAuth):
+		return ExitOAuth
+	case errors.Is(err, errTokenVerification):
+		return ExitTokenVerification
+	case errors.Is(err, errHTTP):
+		return ExitHTTP
+	default:
+		return ExitFailure
+	}
+}
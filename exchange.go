@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Token type identifiers of RFC 8693, section 3.
+const (
+	TokenTypeAccessToken  = "urn:ietf:params:oauth:token-type:access_token"
+	TokenTypeRefreshToken = "urn:ietf:params:oauth:token-type:refresh_token"
+	TokenTypeIDToken      = "urn:ietf:params:oauth:token-type:id_token"
+	TokenTypeJWT          = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+var (
+	errNoSubjectToken = errors.New("no subject token to exchange")
+)
+
+// tokenTypes are the short names accepted for the token type identifiers.
+var tokenTypes = map[string]string{
+	"access_token":  TokenTypeAccessToken,
+	"refresh_token": TokenTypeRefreshToken,
+	"id_token":      TokenTypeIDToken,
+	"jwt":           TokenTypeJWT,
+}
+
+// TokenExchange is a token exchange request (RFC 8693, section 2.1): the
+// subject token is exchanged for a token valid for the audiences and the
+// resources, with the scope, when given.
+type TokenExchange struct {
+	SubjectToken       string
+	SubjectTokenType   string
+	RequestedTokenType string
+	Audience           []string
+	Resource           []string
+	Scope              string
+}
+
+// ExchangeToken exchanges a token at the token endpoint of the provider of
+// the stored client, authenticated as the client.
+func (t *InitClientConfig) ExchangeToken(instance string, exchange TokenExchange) (token TokenResponse, err error) {
+	if exchange.SubjectToken == "" {
+		return token, errNoSubjectToken
+	}
+
+	clientResponse, _, err := t.LoadClient(instance)
+	if err != nil {
+		return token, err
+	}
+
+	provider, err := t.Discover(clientResponse.IssuerEndpoint())
+	if err != nil {
+		return token, err
+	}
+
+	tokenEndpoint, err := requireEndpoint("token_endpoint", provider.TokenEndpoint)
+	if err != nil {
+		return token, err
+	}
+
+	subjectTokenType := exchange.SubjectTokenType
+	if subjectTokenType == "" {
+		subjectTokenType = TokenTypeAccessToken
+	}
+
+	form := url.Values{
+		"grant_type":         {GrantTokenExchange},
+		"subject_token":      {exchange.SubjectToken},
+		"subject_token_type": {subjectTokenType},
+		"audience":           exchange.Audience,
+		"resource":           exchange.Resource,
+	}
+
+	if exchange.RequestedTokenType != "" {
+		form.Set("requested_token_type", exchange.RequestedTokenType)
+	}
+
+	if exchange.Scope != "" {
+		form.Set("scope", exchange.Scope)
+	}
+
+	token, err = t.TokenRequest(tokenEndpoint, clientResponse, form)
+	if err != nil {
+		return token, fmt.Errorf("token exchange %w", err)
+	}
+
+	return token, nil
+}
+
+// stringList is a flag that can be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+
+	return nil
+}
+
+// tokenType expands the short names of the token type identifiers.
+func tokenType(value string) string {
+	if identifier, ok := tokenTypes[value]; ok {
+		return identifier
+	}
+
+	return value
+}
+
+func exchangeOperation(clientIAM *InitClientConfig, instance string, args []string) error {
+	var (
+		exchange TokenExchange
+		output   tokenOutput
+	)
+
+	flags := flag.NewFlagSet("exchange", flag.ContinueOnError)
+	flags.Var((*stringList)(&exchange.Audience), "audience", "audience of the new token, can be repeated")
+	flags.Var((*stringList)(&exchange.Resource), "resource", "resource URI of the new token, can be repeated")
+	flags.StringVar(&exchange.Scope, "scope", "", "scopes of the new token, space separated")
+	subjectTokenType := flags.String("subject-token-type", "access_token", "type of the subject token")
+	requestedTokenType := flags.String("requested-token-type", "", "type of the new token")
+	asJSON := flags.Bool("json", false, "print the whole token response")
+	output.register(flags)
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	exchange.SubjectToken, err = tokenArgument(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	exchange.SubjectTokenType = tokenType(*subjectTokenType)
+	exchange.RequestedTokenType = tokenType(*requestedTokenType)
+
+	token, err := clientIAM.ExchangeToken(instance, exchange)
+	if err != nil {
+		return err
+	}
+
+	written, err := output.write(token.AccessToken)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *asJSON:
+		var out bytes.Buffer
+
+		encoder := json.NewEncoder(&out)
+		encoder.SetIndent("", "  ")
+
+		err = encoder.Encode(token)
+		if err != nil {
+			return fmt.Errorf("token exchange %w", err)
+		}
+
+		fmt.Print(out.String())
+	case !written:
+		fmt.Println(token.AccessToken)
+	}
+
+	return nil
+}
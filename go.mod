@@ -5,7 +5,10 @@ go 1.14
 require (
 	github.com/awnumar/memguard v0.22.2
 	github.com/denisbrodbeck/machineid v1.0.1
+	github.com/godbus/dbus v0.0.0-20190726142602-4481cbc300e2
 	github.com/gookit/color v1.3.7
 	github.com/rs/zerolog v1.20.0
+	golang.org/x/crypto v0.0.0-20200311171314-f7b00557c8c4
 	golang.org/x/sys v0.0.0-20200302150141-5c8b2ff67527
+	gopkg.in/yaml.v2 v2.4.0
 )
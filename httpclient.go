@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+var (
+	errNoCACert = errors.New("no certificate found")
+)
+
+// tlsHTTPClient returns an HTTP client verifying the server certificates
+// with the system roots, or with the CAs in the <prefix>_CACERT file. The
+// checks are disabled when <prefix>_SKIP_VERIFY is true, as with the Vault
+// CLI settings.
+func tlsHTTPClient(prefix string) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if caFile := os.Getenv(prefix + "_CACERT"); caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s_CACERT %w", prefix, err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("%w in %s_CACERT: %s", errNoCACert, prefix, caFile)
+		}
+	}
+
+	if skipVerify := os.Getenv(prefix + "_SKIP_VERIFY"); skipVerify != "" {
+		skip, err := strconv.ParseBool(skipVerify)
+		if err != nil {
+			return nil, fmt.Errorf("%s_SKIP_VERIFY %w", prefix, err)
+		}
+
+		tlsConfig.InsecureSkipVerify = skip
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}, nil
+}
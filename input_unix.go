@@ -6,6 +6,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"os"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -44,10 +45,25 @@ func readPassword(fd int) (passwordReader, *unix.Termios, error) {
 	return passwordReader(fd), termios, nil
 }
 
+// passwordInput is the controlling terminal, so that the standard input is
+// left to the tokens piped to the operations, or the standard input without
+// one.
+func passwordInput() (fd int, closeInput func()) {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return syscall.Stdin, func() {}
+	}
+
+	return int(tty.Fd()), func() { tty.Close() }
+}
+
 func (t *GetInputWrapper) GetPassword(question string, only4Decription bool) (password *memguard.Enclave, err error) {
 	fmt.Print(question)
 
-	readPasswdFd, termios, errCreateReader := readPassword(syscall.Stdin)
+	inputFd, closeInput := passwordInput()
+	defer closeInput()
+
+	readPasswdFd, termios, errCreateReader := readPassword(inputFd)
 	if errCreateReader != nil {
 		return nil, fmt.Errorf("get password %w", errCreateReader)
 	}
@@ -65,7 +81,7 @@ func (t *GetInputWrapper) GetPassword(question string, only4Decription bool) (pa
 		fmt.Printf("\n%s Sorry, but an empty password is not allowed...\n", color.Red.Sprint("[X]==>"))
 		fmt.Print(question)
 
-		readPasswdFd, termios, errCreateReader = readPassword(syscall.Stdin)
+		readPasswdFd, termios, errCreateReader = readPassword(inputFd)
 		if errCreateReader != nil {
 			return nil, fmt.Errorf("get password %w", errCreateReader)
 		}
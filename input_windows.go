@@ -47,10 +47,24 @@ func readPassword(fd int) (*os.File, error) {
 	return f, nil
 }
 
+// passwordInput is the console, so that the standard input is left to the
+// tokens piped to the operations, or the standard input without one.
+func passwordInput() (fd int, closeInput func()) {
+	console, err := os.OpenFile("CONIN$", os.O_RDWR, 0)
+	if err != nil {
+		return int(syscall.Stdin), func() {}
+	}
+
+	return int(console.Fd()), func() { console.Close() }
+}
+
 func (t *GetInputWrapper) GetPassword(question string, only4Decription bool) (password *memguard.Enclave, err error) {
 	fmt.Print(question)
 
-	readPasswdFd, errCreateReader := readPassword(int(syscall.Stdin))
+	inputFd, closeInput := passwordInput()
+	defer closeInput()
+
+	readPasswdFd, errCreateReader := readPassword(inputFd)
 	if errCreateReader != nil {
 		return nil, fmt.Errorf("get password %w", errCreateReader)
 	}
@@ -68,7 +82,7 @@ func (t *GetInputWrapper) GetPassword(question string, only4Decription bool) (pa
 		fmt.Printf("\n%s Sorry, but an empty password is not allowed...\n", color.Red.Sprint("[X]==>"))
 		fmt.Print(question)
 
-		readPasswdFd, errCreateReader = readPassword(int(syscall.Stdin))
+		readPasswdFd, errCreateReader = readPassword(inputFd)
 		if errCreateReader != nil {
 			return nil, fmt.Errorf("get password %w", errCreateReader)
 		}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gookit/color"
+)
+
+var (
+	errNoToken          = errors.New("no token given")
+	errUnknownTokenHint = errors.New("unknown token type hint, use access_token or refresh_token")
+)
+
+// tokenHints are the token type hints of RFC 7009, section 2.1 and RFC 7662,
+// section 2.1.
+var tokenHints = map[string]bool{
+	"":              true,
+	"access_token":  true,
+	"refresh_token": true,
+}
+
+// IntrospectToken asks the introspection endpoint (RFC 7662) of the provider
+// of the stored client about the token and returns the introspection
+// response. The hint is the token_type_hint, when not empty.
+func (t *InitClientConfig) IntrospectToken(instance string, token string, hint string) ([]byte, error) {
+	clientResponse, provider, err := t.tokenClient(instance, token, hint)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := requireEndpoint("introspection_endpoint", provider.IntrospectionEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	status, body, err := t.postForm(endpoint, provider.AssertionAudience(), clientResponse, tokenForm(token, hint))
+	if err != nil {
+		return nil, err
+	}
+
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("introspection %w", tokenError(status, body))
+	}
+
+	var introspection struct {
+		Active *bool `json:"active"`
+	}
+
+	if json.Unmarshal(body, &introspection) != nil || introspection.Active == nil {
+		return nil, fmt.Errorf("%w: invalid introspection response: %s", errHTTP, body)
+	}
+
+	return body, nil
+}
+
+// RevokeToken revokes the token at the revocation endpoint (RFC 7009) of
+// the provider of the stored client. The hint is the token_type_hint, when
+// not empty.
+func (t *InitClientConfig) RevokeToken(instance string, token string, hint string) error {
+	clientResponse, provider, err := t.tokenClient(instance, token, hint)
+	if err != nil {
+		return err
+	}
+
+	endpoint, err := requireEndpoint("revocation_endpoint", provider.RevocationEndpoint)
+	if err != nil {
+		return err
+	}
+
+	status, body, err := t.postForm(endpoint, provider.AssertionAudience(), clientResponse, tokenForm(token, hint))
+	if err != nil {
+		return err
+	}
+
+	// Invalid tokens are also answered with 200 (RFC 7009, section 2.2)
+	if status != http.StatusOK {
+		return fmt.Errorf("revocation %w", tokenError(status, body))
+	}
+
+	return nil
+}
+
+// tokenClient checks the arguments of the token operations and returns the
+// stored client and the metadata of its provider.
+func (t *InitClientConfig) tokenClient(instance string, token string, hint string) (clientResponse ClientResponse, provider *ProviderMetadata, err error) { //nolint:lll
+	if token == "" {
+		return clientResponse, nil, errNoToken
+	}
+
+	if !tokenHints[hint] {
+		return clientResponse, nil, fmt.Errorf("%w: %q", errUnknownTokenHint, hint)
+	}
+
+	clientResponse, _, err = t.LoadClient(instance)
+	if err != nil {
+		return clientResponse, nil, err
+	}
+
+	provider, err = t.Discover(clientResponse.IssuerEndpoint())
+	if err != nil {
+		return clientResponse, nil, err
+	}
+
+	return clientResponse, provider, nil
+}
+
+func tokenForm(token string, hint string) url.Values {
+	form := url.Values{
+		"token": {token},
+	}
+
+	if hint != "" {
+		form.Set("token_type_hint", hint)
+	}
+
+	return form
+}
+
+func introspectOperation(clientIAM *InitClientConfig, instance string, args []string) error {
+	flags := flag.NewFlagSet("introspect", flag.ContinueOnError)
+	hint := flags.String("hint", "", "type of the token: access_token or refresh_token")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	token, err := tokenArgument(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	body, err := clientIAM.IntrospectToken(instance, token, *hint)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+
+	err = json.Indent(&out, body, "", "  ")
+	if err != nil {
+		return fmt.Errorf("introspection %w", err)
+	}
+
+	fmt.Println(out.String())
+
+	return nil
+}
+
+func revokeOperation(clientIAM *InitClientConfig, instance string, args []string) error {
+	flags := flag.NewFlagSet("revoke", flag.ContinueOnError)
+	hint := flags.String("hint", "", "type of the token: access_token or refresh_token")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	token, err := tokenArgument(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	err = clientIAM.RevokeToken(instance, token, *hint)
+	if err != nil {
+		return err
+	}
+
+	color.Green.Println("==> Token revoked")
+
+	return nil
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	errUnsupportedKey = errors.New("unsupported private key")
+	errNoPEM          = errors.New("no PEM block found")
+	errNotAJWT        = errors.New("not a JWT")
+	errUnsupportedAlg = errors.New("unsupported signature algorithm")
+	errNoVerifyKey    = errors.New("no key of the key set matches the token")
+	errBadSignature   = errors.New("invalid token signature")
+)
+
+// LoadPrivateKey reads a PEM encoded RSA or EC private key, in PKCS#1,
+// SEC 1 or PKCS#8 form.
+func LoadPrivateKey(filename string) (crypto.Signer, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("load private key %w", err)
+	}
+
+	return ParsePrivateKey(content)
+}
+
+// ParsePrivateKey decodes a PEM encoded RSA or EC private key.
+func ParsePrivateKey(content []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errNoPEM
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key %w", err)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%w: %T", errUnsupportedKey, key)
+	}
+}
+
+// signingAlgorithm returns the JWS algorithm (RFC 7518) used for the key.
+func signingAlgorithm(key crypto.Signer) (alg string, hash crypto.Hash, err error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return "RS256", crypto.SHA256, nil
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return "ES256", crypto.SHA256, nil
+		case elliptic.P384():
+			return "ES384", crypto.SHA384, nil
+		case elliptic.P521():
+			return "ES512", crypto.SHA512, nil
+		}
+	}
+
+	return "", 0, fmt.Errorf("%w: %T", errUnsupportedKey, key)
+}
+
+func digest(hash crypto.Hash, data []byte) []byte {
+	switch hash {
+	case crypto.SHA384:
+		sum := sha512.Sum384(data)
+
+		return sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(data)
+
+		return sum[:]
+	default:
+		sum := sha256.Sum256(data)
+
+		return sum[:]
+	}
+}
+
+// SignJWT creates a compact JWS (RFC 7515) of the claims, signed with the
+// key. The kid header is set when not empty.
+func SignJWT(key crypto.Signer, kid string, claims interface{}) (string, error) {
+	alg, hash, err := signingAlgorithm(key)
+	if err != nil {
+		return "", err
+	}
+
+	header := map[string]string{
+		"alg": alg,
+		"typ": "JWT",
+	}
+
+	if kid != "" {
+		header["kid"] = kid
+	}
+
+	encodedHeader, err := json.Marshal(header)
+	if err != nil {
+		return "", fmt.Errorf("sign jwt %w", err)
+	}
+
+	encodedClaims, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("sign jwt %w", err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(encodedHeader) + "." +
+		base64.RawURLEncoding.EncodeToString(encodedClaims)
+
+	hashed := digest(hash, []byte(signingInput))
+
+	var signature []byte
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, hashed)
+		if err != nil {
+			return "", fmt.Errorf("sign jwt %w", err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, errSign := ecdsa.Sign(rand.Reader, key, hashed)
+		if errSign != nil {
+			return "", fmt.Errorf("sign jwt %w", errSign)
+		}
+
+		// JWS uses the fixed size concatenation of r and s (RFC 7518, section 3.4)
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = append(padBigInt(r, size), padBigInt(s, size)...)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func padBigInt(value *big.Int, size int) []byte {
+	out := make([]byte, size)
+	b := value.Bytes()
+
+	copy(out[size-len(b):], b)
+
+	return out
+}
+
+// JWK is the JSON Web Key (RFC 7517) representation of a public key.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// PublicJWK returns the public part of the key as a signing JWK, identified
+// by its thumbprint (RFC 7638).
+func PublicJWK(key crypto.Signer) (jwk JWK, err error) {
+	alg, _, err := signingAlgorithm(key)
+	if err != nil {
+		return jwk, err
+	}
+
+	var thumbprintInput string
+
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		thumbprintInput = fmt.Sprintf(`{"e":%q,"kty":%q,"n":%q}`, jwk.E, jwk.Kty, jwk.N)
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(padBigInt(pub.X, size))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(padBigInt(pub.Y, size))
+		thumbprintInput = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk.Crv, jwk.Kty, jwk.X, jwk.Y)
+	}
+
+	thumbprint := sha256.Sum256([]byte(thumbprintInput))
+
+	jwk.Kid = base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	jwk.Use = "sig"
+	jwk.Alg = alg
+
+	return jwk, nil
+}
+
+// GenerateKey creates a new "rsa" or "ec" (P-256) private key.
+func GenerateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "ec":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("%w: key type %q", errUnsupportedKey, keyType)
+	}
+}
+
+// EncodePrivateKey returns the PKCS#8 PEM encoding of the key.
+func EncodePrivateKey(key crypto.Signer) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", fmt.Errorf("encode private key %w", err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// ClientAssertion creates the JWT used to authenticate the client with
+// private_key_jwt at the given endpoint (RFC 7523, section 2.2).
+func ClientAssertion(clientID string, key crypto.Signer, audience string) (string, error) {
+	jwk, err := PublicJWK(key)
+	if err != nil {
+		return "", err
+	}
+
+	jti := make([]byte, 16)
+
+	_, err = rand.Read(jti)
+	if err != nil {
+		return "", fmt.Errorf("client assertion %w", err)
+	}
+
+	now := time.Now()
+
+	return SignJWT(key, jwk.Kid, map[string]interface{}{
+		"iss": clientID,
+		"sub": clientID,
+		"aud": audience,
+		"jti": base64.RawURLEncoding.EncodeToString(jti),
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+	})
+}
+
+// DecodeJWT returns the decoded header and claims of a compact JWS, without
+// verifying its signature.
+func DecodeJWT(token string) (header map[string]interface{}, claims map[string]interface{}, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, errNotAJWT
+	}
+
+	for i, target := range []*map[string]interface{}{&header, &claims} {
+		content, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[i], "="))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s", errNotAJWT, err)
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+
+		err = decoder.Decode(target)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s", errNotAJWT, err)
+		}
+	}
+
+	return header, claims, nil
+}
+
+// PublicKey returns the RSA or EC public key of the JWK.
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		content, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+		if err != nil {
+			return nil, fmt.Errorf("%w: jwk %s", errUnsupportedKey, err)
+		}
+
+		return new(big.Int).SetBytes(content), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{
+			"P-256": elliptic.P256(),
+			"P-384": elliptic.P384(),
+			"P-521": elliptic.P521(),
+		}
+
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("%w: jwk curve %q", errUnsupportedKey, k.Crv)
+		}
+
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("%w: jwk type %q", errUnsupportedKey, k.Kty)
+	}
+}
+
+// verifySignature checks the JWS signature of the signing input with the
+// public key, for the RS, PS and ES algorithms of RFC 7518.
+func verifySignature(alg string, key crypto.PublicKey, signingInput string, signature []byte) error {
+	hashes := map[string]crypto.Hash{
+		"256": crypto.SHA256,
+		"384": crypto.SHA384,
+		"512": crypto.SHA512,
+	}
+
+	if len(alg) != 5 {
+		return fmt.Errorf("%w: %q", errUnsupportedAlg, alg)
+	}
+
+	hash, ok := hashes[alg[2:]]
+	if !ok {
+		return fmt.Errorf("%w: %q", errUnsupportedAlg, alg)
+	}
+
+	hashed := digest(hash, []byte(signingInput))
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(key, hash, hashed, signature)
+		case "PS":
+			err = rsa.VerifyPSS(key, hash, hashed, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		default:
+			return fmt.Errorf("%w: %s with an RSA key", errUnsupportedAlg, alg)
+		}
+
+		if err != nil {
+			return errBadSignature
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(signature) != 2*size {
+			return fmt.Errorf("%w: %s with an EC key", errUnsupportedAlg, alg)
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+
+		if !ecdsa.Verify(key, hashed, r, s) {
+			return errBadSignature
+		}
+	default:
+		return fmt.Errorf("%w: %T", errUnsupportedKey, key)
+	}
+
+	return nil
+}
+
+// VerifyJWT checks the signature of a compact JWS with the matching key of
+// the key set: the one with the kid of the token header, or any signing key
+// when the token has no kid. It returns the key used.
+func VerifyJWT(token string, keys []JWK) (JWK, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return JWK{}, errNotAJWT
+	}
+
+	header, _, err := DecodeJWT(token)
+	if err != nil {
+		return JWK{}, err
+	}
+
+	alg, _ := header["alg"].(string)
+	kid, _ := header["kid"].(string)
+
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return JWK{}, fmt.Errorf("%w: %s", errNotAJWT, err)
+	}
+
+	err = errNoVerifyKey
+
+	for _, jwk := range keys {
+		if (kid != "" && jwk.Kid != kid) || jwk.Use == "enc" || (jwk.Alg != "" && jwk.Alg != alg) {
+			continue
+		}
+
+		key, errKey := jwk.PublicKey()
+		if errKey != nil {
+			err = errKey
+
+			continue
+		}
+
+		err = verifySignature(alg, key, parts[0]+"."+parts[1], signature)
+		if err == nil {
+			return jwk, nil
+		}
+	}
+
+	return JWK{}, err
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testKeys are the keys signing the test tokens, generated once.
+type testKeys struct {
+	rsa  *rsa.PrivateKey
+	p256 *ecdsa.PrivateKey
+	p384 *ecdsa.PrivateKey
+	p521 *ecdsa.PrivateKey
+	jwks []JWK
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+
+	var (
+		keys testKeys
+		err  error
+	)
+
+	keys.rsa, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []struct {
+		target **ecdsa.PrivateKey
+		curve  elliptic.Curve
+	}{{&keys.p256, elliptic.P256()}, {&keys.p384, elliptic.P384()}, {&keys.p521, elliptic.P521()}} {
+		*key.target, err = ecdsa.GenerateKey(key.curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for kid, key := range map[string]crypto.Signer{"rsa": keys.rsa, "p256": keys.p256, "p384": keys.p384, "p521": keys.p521} {
+		jwk, err := PublicJWK(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jwk.Kid = kid
+
+		// The RSA key signs with the RS and PS algorithms
+		if jwk.Kty == "RSA" {
+			jwk.Alg = ""
+		}
+
+		keys.jwks = append(keys.jwks, jwk)
+	}
+
+	return keys
+}
+
+// signToken builds a compact JWS with any header, to cover the algorithms
+// SignJWT does not use and the ones a verifier must reject.
+func signToken(t *testing.T, key crypto.Signer, header map[string]interface{}, claims map[string]interface{}) string {
+	t.Helper()
+
+	encode := func(value interface{}) string {
+		content, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return base64.RawURLEncoding.EncodeToString(content)
+	}
+
+	signingInput := encode(header) + "." + encode(claims)
+
+	alg, _ := header["alg"].(string)
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[len(alg)-3:]]
+	hashed := digest(hash, []byte(signingInput))
+
+	var (
+		signature []byte
+		err       error
+	)
+
+	switch {
+	case alg == "none":
+	case strings.HasPrefix(alg, "HS"):
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(signingInput)) // nolint: errcheck
+		signature = mac.Sum(nil)
+	case strings.HasPrefix(alg, "RS"):
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), hash, hashed)
+	case strings.HasPrefix(alg, "PS"):
+		signature, err = rsa.SignPSS(rand.Reader, key.(*rsa.PrivateKey), hash, hashed,
+			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case strings.HasPrefix(alg, "ES"):
+		ecKey := key.(*ecdsa.PrivateKey)
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+
+		r, s, errSign := ecdsa.Sign(rand.Reader, ecKey, hashed)
+		signature, err = append(padBigInt(r, size), padBigInt(s, size)...), errSign
+	default:
+		t.Fatalf("cannot sign with %s", alg)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// breakSignature replaces the signature of the token with the one returned
+// by change.
+func breakSignature(t *testing.T, token string, change func([]byte) []byte) string {
+	t.Helper()
+
+	parts := strings.Split(token, ".")
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts[2] = base64.RawURLEncoding.EncodeToString(change(signature))
+
+	return strings.Join(parts, ".")
+}
+
+func TestVerifyJWT(t *testing.T) {
+	keys := newTestKeys(t)
+	claims := map[string]interface{}{"sub": "user", "iss": "https://iam.example"}
+
+	rs256 := signToken(t, keys.rsa, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, claims)
+	es256 := signToken(t, keys.p256, map[string]interface{}{"alg": "ES256", "kid": "p256"}, claims)
+	tampered := strings.Split(rs256, ".")
+	tampered[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin","iss":"https://iam.example"}`))
+
+	tests := map[string]struct {
+		token string
+		kid   string
+		err   error
+	}{
+		"RS256":     {rs256, "rsa", nil},
+		"RS512":     {signToken(t, keys.rsa, map[string]interface{}{"alg": "RS512", "kid": "rsa"}, claims), "rsa", nil},
+		"PS256":     {signToken(t, keys.rsa, map[string]interface{}{"alg": "PS256", "kid": "rsa"}, claims), "rsa", nil},
+		"PS384":     {signToken(t, keys.rsa, map[string]interface{}{"alg": "PS384", "kid": "rsa"}, claims), "rsa", nil},
+		"ES256":     {es256, "p256", nil},
+		"ES384":     {signToken(t, keys.p384, map[string]interface{}{"alg": "ES384", "kid": "p384"}, claims), "p384", nil},
+		"ES512":     {signToken(t, keys.p521, map[string]interface{}{"alg": "ES512", "kid": "p521"}, claims), "p521", nil},
+		"no kid":    {signToken(t, keys.p384, map[string]interface{}{"alg": "ES384"}, claims), "p384", nil},
+		"alg none":  {signToken(t, nil, map[string]interface{}{"alg": "none", "kid": "rsa"}, claims), "", errUnsupportedAlg},
+		"HS256":     {signToken(t, nil, map[string]interface{}{"alg": "HS256", "kid": "rsa"}, claims), "", errUnsupportedAlg},
+		"wrong kid": {signToken(t, keys.rsa, map[string]interface{}{"alg": "RS256", "kid": "other"}, claims), "", errNoVerifyKey},
+		"key of another curve": {
+			signToken(t, keys.p256, map[string]interface{}{"alg": "ES256", "kid": "p384"}, claims), "", errNoVerifyKey,
+		},
+		"ES short signature": {
+			breakSignature(t, es256, func(signature []byte) []byte { return signature[1:] }), "", errUnsupportedAlg,
+		},
+		"ES long signature": {
+			breakSignature(t, es256, func(signature []byte) []byte { return append(signature, 0) }), "", errUnsupportedAlg,
+		},
+		"tampered claims": {strings.Join(tampered, "."), "", errBadSignature},
+		"not a JWT":       {"header.claims", "", errNotAJWT},
+	}
+
+	for name, test := range tests {
+		jwk, err := VerifyJWT(test.token, keys.jwks)
+
+		switch {
+		case test.err == nil && (err != nil || jwk.Kid != test.kid):
+			t.Errorf("%s: VerifyJWT = %s, %v, want key %s", name, jwk.Kid, err, test.kid)
+		case test.err != nil && !errors.Is(err, test.err):
+			t.Errorf("%s: VerifyJWT error %v, want %v", name, err, test.err)
+		}
+	}
+}
+
+func TestVerifySignatureKeyMismatch(t *testing.T) {
+	keys := newTestKeys(t)
+
+	for alg, key := range map[string]crypto.PublicKey{
+		"ES256": keys.rsa.Public(),
+		"RS256": keys.p256.Public(),
+		"HS256": keys.rsa.Public(),
+		"RS":    keys.rsa.Public(),
+		"RS128": keys.rsa.Public(),
+	} {
+		err := verifySignature(alg, key, "input", []byte("signature"))
+		if !errors.Is(err, errUnsupportedAlg) {
+			t.Errorf("%s: verifySignature error %v, want %v", alg, err, errUnsupportedAlg)
+		}
+	}
+}
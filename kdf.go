@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// encryptedMagic starts the versioned encrypted client files. The files
+// without it are the legacy ones, with the key derived by CreateHash.
+var encryptedMagic = []byte("IAMCREC")
+
+// Versions of the encrypted file format: the version 2 authenticates the
+// header and the instance name as associated data.
+const (
+	encryptedVersion1 = 1
+	encryptedVersion  = 2
+	kdfArgon2id       = 1
+	kdfSaltSize       = 16
+	kdfKeySize        = 32
+	// kdfMaxMemory, kdfMaxTime and kdfMaxThreads bound the cost a file
+	// header can ask for: the memory in KiB, the passes and the lanes
+	kdfMaxMemory  = 1024 * 1024
+	kdfMaxTime    = 16
+	kdfMaxThreads = 16
+)
+
+var (
+	errEncryptedFormat  = errors.New("invalid encrypted client file")
+	errEndpointMismatch = errors.New("the client is stored for another IAM endpoint")
+	errDecrypt          = errors.New("cannot decrypt the client: wrong password, or the file was modified or belongs to another instance") //nolint:lll
+)
+
+// KDFParams are the Argon2id (RFC 9106) parameters of an encrypted file,
+// stored in its header.
+type KDFParams struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+	Salt    []byte
+}
+
+// DefaultKDFParams returns the parameters of the new files, the second
+// recommended option of RFC 9106, section 4, with a random salt.
+func DefaultKDFParams() (KDFParams, error) {
+	params := KDFParams{
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+		Salt:    make([]byte, kdfSaltSize),
+	}
+
+	_, err := io.ReadFull(rand.Reader, params.Salt)
+	if err != nil {
+		return params, fmt.Errorf("kdf salt %w", err)
+	}
+
+	return params, nil
+}
+
+// validate checks the parameters read from a file before deriving a key.
+func (p KDFParams) validate() error {
+	switch {
+	case p.Time < 1 || p.Time > kdfMaxTime:
+		return fmt.Errorf("%w: kdf time %d", errEncryptedFormat, p.Time)
+	case p.Threads < 1 || p.Threads > kdfMaxThreads:
+		return fmt.Errorf("%w: kdf threads %d", errEncryptedFormat, p.Threads)
+	case p.Memory > kdfMaxMemory:
+		return fmt.Errorf("%w: kdf memory %d KiB", errEncryptedFormat, p.Memory)
+	case len(p.Salt) < kdfSaltSize:
+		return fmt.Errorf("%w: kdf salt of %d bytes", errEncryptedFormat, len(p.Salt))
+	}
+
+	return nil
+}
+
+// Key derives the encryption key from the passphrase.
+func (p KDFParams) Key(passphrase []byte) []byte {
+	return argon2.IDKey(passphrase, p.Salt, p.Time, p.Memory, p.Threads, kdfKeySize)
+}
+
+// isLegacyEncrypted tells whether the file predates the versioned format.
+func isLegacyEncrypted(data []byte) bool {
+	return !bytes.HasPrefix(data, encryptedMagic)
+}
+
+// needsMigration tells whether the file predates the current format.
+func needsMigration(data []byte) bool {
+	if isLegacyEncrypted(data) {
+		return true
+	}
+
+	header, _, err := decodeHeader(data)
+
+	return err == nil && header.Version < encryptedVersion
+}
+
+// encryptedHeader is the header of an encrypted file: the format version,
+// the key derivation parameters and the IAM endpoint of the client.
+type encryptedHeader struct {
+	Version  uint8
+	Params   KDFParams
+	Endpoint string
+}
+
+// encode returns the header as written before the nonce and the ciphertext.
+func (h encryptedHeader) encode() []byte {
+	var header bytes.Buffer
+
+	header.Write(encryptedMagic)
+	header.WriteByte(h.Version)
+	header.WriteByte(kdfArgon2id)
+	_ = binary.Write(&header, binary.BigEndian, h.Params.Time)
+	_ = binary.Write(&header, binary.BigEndian, h.Params.Memory)
+	header.WriteByte(h.Params.Threads)
+	header.WriteByte(byte(len(h.Params.Salt)))
+	header.Write(h.Params.Salt)
+
+	if h.Version >= encryptedVersion {
+		_ = binary.Write(&header, binary.BigEndian, uint16(len(h.Endpoint)))
+		header.WriteString(h.Endpoint)
+	}
+
+	return header.Bytes()
+}
+
+// associatedData binds the ciphertext to the header, so to the format
+// version and the endpoint, and to the instance name.
+func (h encryptedHeader) associatedData(instance string) []byte {
+	if h.Version < encryptedVersion {
+		return nil
+	}
+
+	return append(h.encode(), instance...)
+}
+
+// decodeHeader parses the header of an encrypted file and returns the rest
+// of the file.
+func decodeHeader(data []byte) (header encryptedHeader, rest []byte, err error) {
+	reader := bytes.NewReader(data[len(encryptedMagic):])
+
+	var fixed struct {
+		Version uint8
+		KDF     uint8
+		Time    uint32
+		Memory  uint32
+		Threads uint8
+		SaltLen uint8
+	}
+
+	err = binary.Read(reader, binary.BigEndian, &fixed)
+	if err != nil {
+		return header, nil, fmt.Errorf("%w: %s", errEncryptedFormat, err)
+	}
+
+	if fixed.Version != encryptedVersion1 && fixed.Version != encryptedVersion {
+		return header, nil, fmt.Errorf("%w: unknown version %d", errEncryptedFormat, fixed.Version)
+	}
+
+	if fixed.KDF != kdfArgon2id {
+		return header, nil, fmt.Errorf("%w: unknown key derivation %d", errEncryptedFormat, fixed.KDF)
+	}
+
+	header = encryptedHeader{
+		Version: fixed.Version,
+		Params: KDFParams{
+			Time:    fixed.Time,
+			Memory:  fixed.Memory,
+			Threads: fixed.Threads,
+			Salt:    make([]byte, fixed.SaltLen),
+		},
+	}
+
+	_, err = io.ReadFull(reader, header.Params.Salt)
+	if err != nil {
+		return header, nil, fmt.Errorf("%w: %s", errEncryptedFormat, err)
+	}
+
+	// The header is authenticated only after the key derivation, which
+	// argon2 refuses with a panic or could make exhaust the memory
+	err = header.Params.validate()
+	if err != nil {
+		return header, nil, err
+	}
+
+	if header.Version >= encryptedVersion {
+		var endpointLen uint16
+
+		err = binary.Read(reader, binary.BigEndian, &endpointLen)
+		if err != nil {
+			return header, nil, fmt.Errorf("%w: %s", errEncryptedFormat, err)
+		}
+
+		endpoint := make([]byte, endpointLen)
+
+		_, err = io.ReadFull(reader, endpoint)
+		if err != nil {
+			return header, nil, fmt.Errorf("%w: %s", errEncryptedFormat, err)
+		}
+
+		header.Endpoint = string(endpoint)
+	}
+
+	return header, data[len(data)-reader.Len():], nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/awnumar/memguard"
+)
+
+func TestDecodeHeaderRejectsBadParams(t *testing.T) {
+	params, err := DefaultKDFParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tamper := range map[string]func(*KDFParams){
+		"no time":      func(p *KDFParams) { p.Time = 0 },
+		"no threads":   func(p *KDFParams) { p.Threads = 0 },
+		"huge memory":  func(p *KDFParams) { p.Memory = 1<<32 - 1 },
+		"over memory":  func(p *KDFParams) { p.Memory = kdfMaxMemory + 1 },
+		"long time":    func(p *KDFParams) { p.Time = kdfMaxTime + 1 },
+		"huge time":    func(p *KDFParams) { p.Time = 1<<32 - 1 },
+		"many threads": func(p *KDFParams) { p.Threads = kdfMaxThreads + 1 },
+		"short salt":   func(p *KDFParams) { p.Salt = p.Salt[:4] },
+	} {
+		tampered := params
+		tampered.Salt = append([]byte(nil), params.Salt...)
+		tamper(&tampered)
+
+		data := encryptedHeader{Version: encryptedVersion, Params: tampered, Endpoint: "https://iam.example"}.encode()
+		data = append(data, make([]byte, 64)...)
+
+		_, _, err := decodeHeader(data)
+		if !errors.Is(err, errEncryptedFormat) {
+			t.Errorf("%s: decodeHeader error %v, want %v", name, err, errEncryptedFormat)
+		}
+
+		_, _, err = Decrypt(data, memguard.NewEnclave([]byte("password")), "instance")
+		if !errors.Is(err, errEncryptedFormat) {
+			t.Errorf("%s: Decrypt error %v, want %v", name, err, errEncryptedFormat)
+		}
+	}
+}
+
+func TestKDFParamsLimits(t *testing.T) {
+	params, err := DefaultKDFParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := params.validate(); err != nil {
+		t.Errorf("default params: %v", err)
+	}
+
+	params.Time, params.Memory, params.Threads = kdfMaxTime, kdfMaxMemory, kdfMaxThreads
+
+	if err := params.validate(); err != nil {
+		t.Errorf("maximum params: %v", err)
+	}
+}
+
+// sealV1 writes a file of the version 1 format, without associated data.
+func sealV1(t *testing.T, data []byte, password string) []byte {
+	t.Helper()
+
+	params, err := DefaultKDFParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := encryptedHeader{Version: encryptedVersion1, Params: params}
+
+	return seal(t, params.Key([]byte(password)), header.encode(), data)
+}
+
+// sealLegacy writes a file of the format without header.
+func sealLegacy(t *testing.T, data []byte, password string) []byte {
+	t.Helper()
+
+	hash, err := CreateHash(password)
+	if err != nil {
+		t.Skip("no machine id:", err)
+	}
+
+	return seal(t, []byte(hash), nil, data)
+}
+
+func seal(t *testing.T, key []byte, header []byte, data []byte) []byte {
+	t.Helper()
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+
+	return gcm.Seal(append(header, nonce...), nonce, data, nil)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	data := []byte(`{"client_id":"id"}`)
+	password := memguard.NewEnclave([]byte("password"))
+
+	sealed, err := Encrypt(data, password, "instance", "https://iam.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if needsMigration(sealed) {
+		t.Error("needsMigration of a current file")
+	}
+
+	plaintext, endpoint, err := Decrypt(sealed, password, "instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(plaintext, data) || endpoint != "https://iam.example" {
+		t.Errorf("Decrypt = %q, %q", plaintext, endpoint)
+	}
+
+	_, _, err = Decrypt(sealed, memguard.NewEnclave([]byte("wrong")), "instance")
+	if !errors.Is(err, errDecrypt) {
+		t.Errorf("wrong password: error %v, want %v", err, errDecrypt)
+	}
+}
+
+func TestDecryptAssociatedData(t *testing.T) {
+	password := memguard.NewEnclave([]byte("password"))
+
+	sealed, err := Encrypt([]byte(`{}`), password, "instance", "https://iam.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = Decrypt(sealed, password, "other")
+	if !errors.Is(err, errDecrypt) {
+		t.Errorf("swapped instance: error %v, want %v", err, errDecrypt)
+	}
+
+	header, rest, err := decodeHeader(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same length, so that only the authentication can notice
+	header.Endpoint = "https://iam.evil.xx"
+	swapped := append(header.encode(), rest...)
+
+	_, _, err = Decrypt(swapped, password, "instance")
+	if !errors.Is(err, errDecrypt) {
+		t.Errorf("swapped endpoint: error %v, want %v", err, errDecrypt)
+	}
+}
+
+func TestDecryptPreviousFormats(t *testing.T) {
+	data := []byte(`{"client_id":"id"}`)
+	password := memguard.NewEnclave([]byte("password"))
+
+	for name, sealed := range map[string][]byte{
+		"version 1": sealV1(t, data, "password"),
+		"legacy":    sealLegacy(t, data, "password"),
+	} {
+		if !needsMigration(sealed) {
+			t.Errorf("%s: needsMigration false", name)
+		}
+
+		plaintext, endpoint, err := Decrypt(sealed, password, "instance")
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+
+			continue
+		}
+
+		if !bytes.Equal(plaintext, data) || endpoint != "" {
+			t.Errorf("%s: Decrypt = %q, %q", name, plaintext, endpoint)
+		}
+	}
+}
+
+func TestLoadClientMigrates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iamclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// LoadClient uses this password when REFRESH_TOKEN is set
+	os.Setenv("REFRESH_TOKEN", "token")
+	defer os.Unsetenv("REFRESH_TOKEN")
+
+	store := EncryptedFileStore{FileStore{Dir: dir}}
+
+	err = store.Save("instance", sealV1(t, []byte(`{"client_id":"id","issuer":"https://iam.example"}`), "nopassword"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientIAM := &InitClientConfig{Store: store, IAMServer: "https://iam.example"}
+
+	clientResponse, _, err := clientIAM.LoadClient("instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if clientResponse.ClientID != "id" {
+		t.Errorf("client id %q", clientResponse.ClientID)
+	}
+
+	body, err := store.Load("instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if needsMigration(body) {
+		t.Error("the client was not migrated")
+	}
+
+	_, endpoint, err := Decrypt(body, memguard.NewEnclave([]byte("nopassword")), "instance")
+	if err != nil || endpoint != "https://iam.example" {
+		t.Errorf("migrated client: endpoint %q, error %v", endpoint, err)
+	}
+}
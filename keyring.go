@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus"
+)
+
+// Names of the freedesktop.org Secret Service API.
+const (
+	secretServiceName     = "org.freedesktop.secrets"
+	secretServicePath     = "/org/freedesktop/secrets"
+	secretServiceIface    = "org.freedesktop.Secret.Service"
+	secretCollectionIface = "org.freedesktop.Secret.Collection"
+	secretItemIface       = "org.freedesktop.Secret.Item"
+	secretPromptIface     = "org.freedesktop.Secret.Prompt"
+	secretNoPrompt        = dbus.ObjectPath("/")
+)
+
+// KeyringPromptTimeout is how long the user has to answer the unlock
+// prompts of the keyring.
+var KeyringPromptTimeout = 2 * time.Minute
+
+var (
+	errNoKeyring       = errors.New("no default keyring collection")
+	errKeyringPrompt   = errors.New("the keyring prompt was dismissed")
+	errKeyringTimedOut = errors.New("timeout waiting for the keyring prompt")
+)
+
+// secretServiceSecret is the Secret struct of the Secret Service API.
+type secretServiceSecret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+// KeyringStore keeps the clients in the default collection of the keyring
+// of the user, with the Secret Service D-Bus API on the session bus. The
+// items have the application and instance attributes.
+type KeyringStore struct {
+	conn       *dbus.Conn
+	session    dbus.ObjectPath
+	collection dbus.ObjectPath
+}
+
+// NewKeyringStore opens a session, without transport encryption on the
+// local session bus, with the Secret Service of the user.
+func NewKeyringStore() (*KeyringStore, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("keyring %w", err)
+	}
+
+	return newKeyringStore(conn)
+}
+
+func newKeyringStore(conn *dbus.Conn) (*KeyringStore, error) {
+	store := &KeyringStore{
+		conn: conn,
+	}
+
+	var output dbus.Variant
+
+	err := store.service().Call(secretServiceIface+".OpenSession", 0, "plain", dbus.MakeVariant("")).
+		Store(&output, &store.session)
+	if err != nil {
+		return nil, fmt.Errorf("keyring open session %w", err)
+	}
+
+	err = store.service().Call(secretServiceIface+".ReadAlias", 0, "default").Store(&store.collection)
+	if err != nil {
+		return nil, fmt.Errorf("keyring %w", err)
+	}
+
+	if store.collection == secretNoPrompt {
+		return nil, errNoKeyring
+	}
+
+	return store, nil
+}
+
+func (s *KeyringStore) service() dbus.BusObject {
+	return s.conn.Object(secretServiceName, secretServicePath)
+}
+
+func (s *KeyringStore) object(path dbus.ObjectPath) dbus.BusObject {
+	return s.conn.Object(secretServiceName, path)
+}
+
+func keyringAttributes(instance string) map[string]string {
+	return map[string]string{
+		"application": "dodas-IAMClientRec",
+		"instance":    instance,
+	}
+}
+
+// prompt shows a prompt of the Secret Service, e.g. to unlock the keyring,
+// and waits for the user to complete it.
+func (s *KeyringStore) prompt(path dbus.ObjectPath) (dbus.Variant, error) {
+	var result dbus.Variant
+
+	if path == secretNoPrompt {
+		return result, nil
+	}
+
+	err := s.conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(path),
+		dbus.WithMatchInterface(secretPromptIface),
+		dbus.WithMatchMember("Completed"),
+	)
+	if err != nil {
+		return result, fmt.Errorf("keyring prompt %w", err)
+	}
+
+	signals := make(chan *dbus.Signal, 1)
+	s.conn.Signal(signals)
+
+	defer s.conn.RemoveSignal(signals)
+
+	err = s.object(path).Call(secretPromptIface+".Prompt", 0, "").Err
+	if err != nil {
+		return result, fmt.Errorf("keyring prompt %w", err)
+	}
+
+	for {
+		select {
+		case signal := <-signals:
+			if signal.Path != path || signal.Name != secretPromptIface+".Completed" || len(signal.Body) != 2 {
+				continue
+			}
+
+			if dismissed, _ := signal.Body[0].(bool); dismissed {
+				return result, errKeyringPrompt
+			}
+
+			result, _ = signal.Body[1].(dbus.Variant)
+
+			return result, nil
+		case <-time.After(KeyringPromptTimeout):
+			return result, errKeyringTimedOut
+		}
+	}
+}
+
+// unlock unlocks the objects, prompting the user when needed.
+func (s *KeyringStore) unlock(paths []dbus.ObjectPath) error {
+	var (
+		unlocked []dbus.ObjectPath
+		prompt   dbus.ObjectPath
+	)
+
+	err := s.service().Call(secretServiceIface+".Unlock", 0, paths).Store(&unlocked, &prompt)
+	if err != nil {
+		return fmt.Errorf("keyring unlock %w", err)
+	}
+
+	_, err = s.prompt(prompt)
+
+	return err
+}
+
+// items returns the items of the instance, in an unlocked collection.
+func (s *KeyringStore) items(instance string) ([]dbus.ObjectPath, error) {
+	err := s.unlock([]dbus.ObjectPath{s.collection})
+	if err != nil {
+		return nil, err
+	}
+
+	var items []dbus.ObjectPath
+
+	err = s.object(s.collection).Call(secretCollectionIface+".SearchItems", 0, keyringAttributes(instance)).
+		Store(&items)
+	if err != nil {
+		return nil, fmt.Errorf("keyring search %w", err)
+	}
+
+	return items, nil
+}
+
+// Load reads the secret of the client item.
+func (s *KeyringStore) Load(instance string) ([]byte, error) {
+	items, err := s.items(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%w: %s", errClientNotStored, s.Location(instance))
+	}
+
+	err = s.unlock(items[:1])
+	if err != nil {
+		return nil, err
+	}
+
+	var secret secretServiceSecret
+
+	err = s.object(items[0]).Call(secretItemIface+".GetSecret", 0, s.session).Store(&secret)
+	if err != nil {
+		return nil, fmt.Errorf("keyring get secret %w", err)
+	}
+
+	return secret.Value, nil
+}
+
+// Save creates the client item, or replaces its secret.
+func (s *KeyringStore) Save(instance string, body []byte) error {
+	err := s.unlock([]dbus.ObjectPath{s.collection})
+	if err != nil {
+		return err
+	}
+
+	properties := map[string]dbus.Variant{
+		secretItemIface + ".Label":      dbus.MakeVariant("dodas-IAMClientRec " + instance),
+		secretItemIface + ".Attributes": dbus.MakeVariant(keyringAttributes(instance)),
+	}
+
+	secret := secretServiceSecret{
+		Session:     s.session,
+		Parameters:  []byte{},
+		Value:       body,
+		ContentType: "application/json",
+	}
+
+	var item, prompt dbus.ObjectPath
+
+	err = s.object(s.collection).Call(secretCollectionIface+".CreateItem", 0, properties, secret, true).
+		Store(&item, &prompt)
+	if err != nil {
+		return fmt.Errorf("keyring create item %w", err)
+	}
+
+	_, err = s.prompt(prompt)
+
+	return err
+}
+
+// Delete removes the client items.
+func (s *KeyringStore) Delete(instance string) error {
+	items, err := s.items(instance)
+	if err != nil {
+		return err
+	}
+
+	if len(items) == 0 {
+		return fmt.Errorf("%w: %s", errClientNotStored, s.Location(instance))
+	}
+
+	for _, item := range items {
+		var prompt dbus.ObjectPath
+
+		err = s.object(item).Call(secretItemIface+".Delete", 0).Store(&prompt)
+		if err != nil {
+			return fmt.Errorf("keyring delete %w", err)
+		}
+
+		_, err = s.prompt(prompt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Exists tells whether the keyring has an item for the client.
+func (s *KeyringStore) Exists(instance string) (bool, error) {
+	items, err := s.items(instance)
+	if err != nil {
+		return false, err
+	}
+
+	return len(items) > 0, nil
+}
+
+// Encrypted is false, the keyring encrypts the secrets itself.
+func (s *KeyringStore) Encrypted() bool {
+	return false
+}
+
+// Location is the keyring item of the client.
+func (s *KeyringStore) Location(instance string) string {
+	return fmt.Sprintf("keyring item %q", "dodas-IAMClientRec "+instance)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus"
+)
+
+const (
+	fakeCollectionPath = dbus.ObjectPath(secretServicePath + "/collection/login")
+	fakePromptPath     = dbus.ObjectPath(secretServicePath + "/prompt/unlock")
+)
+
+// fakeSecretService is a stand-in Secret Service, keeping its items in
+// memory. The collection must be unlocked with a prompt.
+type fakeSecretService struct {
+	mu       sync.Mutex
+	conn     *dbus.Conn
+	items    map[dbus.ObjectPath]*fakeSecretItem
+	created  int
+	prompted int
+	unlocked bool
+}
+
+type fakeSecretItem struct {
+	service    *fakeSecretService
+	path       dbus.ObjectPath
+	attributes map[string]string
+	secret     secretServiceSecret
+}
+
+func (f *fakeSecretService) OpenSession(algorithm string, input dbus.Variant) (dbus.Variant, dbus.ObjectPath, *dbus.Error) {
+	if algorithm != "plain" {
+		return dbus.Variant{}, "", dbus.NewError("org.freedesktop.DBus.Error.NotSupported", nil)
+	}
+
+	return dbus.MakeVariant(""), secretServicePath + "/session/1", nil
+}
+
+func (f *fakeSecretService) ReadAlias(name string) (dbus.ObjectPath, *dbus.Error) {
+	return fakeCollectionPath, nil
+}
+
+func (f *fakeSecretService) Unlock(objects []dbus.ObjectPath) ([]dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.unlocked {
+		return []dbus.ObjectPath{}, fakePromptPath, nil
+	}
+
+	return objects, secretNoPrompt, nil
+}
+
+func (f *fakeSecretService) Prompt(windowID string) *dbus.Error {
+	f.mu.Lock()
+	f.prompted++
+	f.unlocked = true
+	f.mu.Unlock()
+
+	go f.conn.Emit(fakePromptPath, secretPromptIface+".Completed", false, // nolint: errcheck
+		dbus.MakeVariant([]dbus.ObjectPath{fakeCollectionPath}))
+
+	return nil
+}
+
+func (f *fakeSecretService) locked() *dbus.Error {
+	if !f.unlocked {
+		return dbus.NewError("org.freedesktop.Secret.Error.IsLocked", nil)
+	}
+
+	return nil
+}
+
+func (f *fakeSecretService) SearchItems(attributes map[string]string) ([]dbus.ObjectPath, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	items := []dbus.ObjectPath{}
+
+	for path, item := range f.items {
+		if matchAttributes(attributes, item.attributes) {
+			items = append(items, path)
+		}
+	}
+
+	return items, nil
+}
+
+func (f *fakeSecretService) CreateItem(properties map[string]dbus.Variant, secret secretServiceSecret, replace bool) (dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) { //nolint:lll
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.locked(); err != nil {
+		return "", "", err
+	}
+
+	attributes, ok := properties[secretItemIface+".Attributes"].Value().(map[string]string)
+	if !ok {
+		return "", "", dbus.NewError("org.freedesktop.DBus.Error.InvalidArgs", nil)
+	}
+
+	for _, item := range f.items {
+		if replace && len(attributes) == len(item.attributes) && matchAttributes(attributes, item.attributes) {
+			item.secret = secret
+
+			return item.path, secretNoPrompt, nil
+		}
+	}
+
+	f.created++
+
+	item := &fakeSecretItem{
+		service:    f,
+		path:       dbus.ObjectPath(fmt.Sprintf("%s/%d", fakeCollectionPath, f.created)),
+		attributes: attributes,
+		secret:     secret,
+	}
+	f.items[item.path] = item
+
+	if err := f.conn.Export(item, item.path, secretItemIface); err != nil {
+		return "", "", dbus.MakeFailedError(err)
+	}
+
+	return item.path, secretNoPrompt, nil
+}
+
+func (i *fakeSecretItem) GetSecret(session dbus.ObjectPath) (secretServiceSecret, *dbus.Error) {
+	i.service.mu.Lock()
+	defer i.service.mu.Unlock()
+
+	if err := i.service.locked(); err != nil {
+		return secretServiceSecret{}, err
+	}
+
+	return i.secret, nil
+}
+
+func (i *fakeSecretItem) Delete() (dbus.ObjectPath, *dbus.Error) {
+	i.service.mu.Lock()
+	defer i.service.mu.Unlock()
+
+	delete(i.service.items, i.path)
+	i.service.conn.Export(nil, i.path, secretItemIface) // nolint: errcheck
+
+	return secretNoPrompt, nil
+}
+
+func matchAttributes(attributes map[string]string, item map[string]string) bool {
+	for key, value := range attributes {
+		if item[key] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// privateBus starts a dbus-daemon for the test and returns its address.
+func privateBus(t *testing.T) string {
+	t.Helper()
+
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("no dbus-daemon:", err)
+	}
+
+	cmd := exec.Command(daemon, "--session", "--nofork", "--print-address")
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		cmd.Process.Kill() // nolint: errcheck
+		cmd.Wait()         // nolint: errcheck
+	})
+
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimSpace(address)
+}
+
+func dialBus(t *testing.T, address string) *dbus.Conn {
+	t.Helper()
+
+	conn, err := dbus.Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	err = conn.Auth(nil)
+	if err == nil {
+		err = conn.Hello()
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func TestKeyringStore(t *testing.T) {
+	address := privateBus(t)
+
+	service := &fakeSecretService{
+		conn:  dialBus(t, address),
+		items: map[dbus.ObjectPath]*fakeSecretItem{},
+	}
+
+	for path, iface := range map[dbus.ObjectPath]string{
+		secretServicePath:  secretServiceIface,
+		fakeCollectionPath: secretCollectionIface,
+		fakePromptPath:     secretPromptIface,
+	} {
+		if err := service.conn.Export(service, path, iface); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reply, err := service.conn.RequestName(secretServiceName, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("RequestName = %v, %v", reply, err)
+	}
+
+	store, err := newKeyringStore(dialBus(t, address))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testClientStore(t, store)
+
+	err = store.Delete("instance")
+	if !errors.Is(err, errClientNotStored) {
+		t.Errorf("Delete of a missing client: error %v, want %v", err, errClientNotStored)
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if service.prompted != 1 {
+		t.Errorf("unlock prompted %d times, want 1", service.prompted)
+	}
+
+	// testClientStore saves twice, CreateItem must have replaced the item
+	if service.created != 1 {
+		t.Errorf("%d items created, want 1", service.created)
+	}
+
+	if len(service.items) != 0 {
+		t.Errorf("items left after delete: %v", service.items)
+	}
+
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// serviceAccountDir holds the credentials of the pod service account.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+var (
+	errNoKubernetes = errors.New("not running in a Kubernetes pod, please set env KUBERNETES_API_SERVER")
+)
+
+// KubernetesStore keeps the clients as Secrets named <Prefix><instance> in
+// a namespace. The client is stored in the client.json key, its id and
+// secret also in the client_id and client_secret keys, to be used as
+// environment variables of the pods. A loaded client is saved with its
+// resourceVersion, failing if another run wrote it in the meantime.
+type KubernetesStore struct {
+	APIServer  string
+	Token      string
+	Namespace  string
+	Prefix     string
+	HTTPClient *http.Client
+
+	// resourceVersions are the Secret versions loaded, by instance
+	resourceVersions map[string]string
+}
+
+// NewKubernetesStore configures a KubernetesStore with the service account
+// of the pod. KUBERNETES_API_SERVER, KUBERNETES_TOKEN (or
+// KUBERNETES_TOKEN_FILE) and KUBERNETES_NAMESPACE override it, and
+// KUBERNETES_SECRET_PREFIX (iam-client- by default) names the Secrets.
+func NewKubernetesStore() (*KubernetesStore, error) {
+	store := &KubernetesStore{
+		APIServer:  strings.TrimSuffix(os.Getenv("KUBERNETES_API_SERVER"), "/"),
+		Namespace:  os.Getenv("KUBERNETES_NAMESPACE"),
+		Prefix:     os.Getenv("KUBERNETES_SECRET_PREFIX"),
+		HTTPClient: &http.Client{},
+	}
+
+	if store.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errNoKubernetes
+		}
+
+		store.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+
+	token, err := envOrFile("KUBERNETES_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+
+	if token == "" {
+		content, err := ioutil.ReadFile(serviceAccountDir + "/token")
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes service account %w", err)
+		}
+
+		token = strings.TrimSpace(string(content))
+	}
+
+	store.Token = token
+
+	if store.Namespace == "" {
+		content, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes service account %w", err)
+		}
+
+		store.Namespace = strings.TrimSpace(string(content))
+	}
+
+	if store.Prefix == "" {
+		store.Prefix = "iam-client-"
+	}
+
+	if caCert, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt"); err == nil {
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
+
+		store.HTTPClient.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: caCertPool,
+			},
+		}
+	}
+
+	return store, nil
+}
+
+// kubernetesSecret is the part of a Secret (core/v1) used by the store.
+type kubernetesSecret struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		ResourceVersion string            `json:"resourceVersion,omitempty"`
+		Labels          map[string]string `json:"labels,omitempty"`
+	} `json:"metadata"`
+	Type string            `json:"type,omitempty"`
+	Data map[string][]byte `json:"data"`
+}
+
+func (s *KubernetesStore) secretName(instance string) string {
+	return strings.ToLower(s.Prefix + instance)
+}
+
+func (s *KubernetesStore) url(name string) string {
+	url := fmt.Sprintf("%s/api/v1/namespaces/%s/secrets", s.APIServer, s.Namespace)
+	if name != "" {
+		url += "/" + name
+	}
+
+	return url
+}
+
+func (s *KubernetesStore) request(method string, url string, body []byte) (status int, rbody []byte, err error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, fmt.Errorf("kubernetes %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+	req.Header.Set("Accept", "application/json")
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return storeRequest(s.HTTPClient, req)
+}
+
+// kubernetesError reports the Status of a Kubernetes API error response.
+func kubernetesError(status int, body []byte) error {
+	var kubeErr struct {
+		Message string `json:"message"`
+	}
+
+	if json.Unmarshal(body, &kubeErr) == nil && kubeErr.Message != "" {
+		return fmt.Errorf("%w: kubernetes %d %s: %s", errHTTP, status, http.StatusText(status), kubeErr.Message)
+	}
+
+	return fmt.Errorf("%w: kubernetes %d %s", errHTTP, status, http.StatusText(status))
+}
+
+// Load reads the client.json key of the client Secret.
+func (s *KubernetesStore) Load(instance string) ([]byte, error) {
+	status, body, err := s.request(http.MethodGet, s.url(s.secretName(instance)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		delete(s.resourceVersions, instance)
+
+		return nil, fmt.Errorf("%w: %s", errClientNotStored, s.Location(instance))
+	default:
+		return nil, kubernetesError(status, body)
+	}
+
+	var secret kubernetesSecret
+
+	err = json.Unmarshal(body, &secret)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid kubernetes response: %s", errHTTP, err)
+	}
+
+	s.setResourceVersion(instance, secret.Metadata.ResourceVersion)
+
+	client, ok := secret.Data["client.json"]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s has no client.json key", errClientNotStored, s.Location(instance))
+	}
+
+	return client, nil
+}
+
+func (s *KubernetesStore) setResourceVersion(instance string, resourceVersion string) {
+	if resourceVersion == "" {
+		delete(s.resourceVersions, instance)
+
+		return
+	}
+
+	if s.resourceVersions == nil {
+		s.resourceVersions = map[string]string{}
+	}
+
+	s.resourceVersions[instance] = resourceVersion
+}
+
+// Save creates the client Secret, or replaces it when it exists. When the
+// client was loaded, the loaded Secret version is replaced.
+func (s *KubernetesStore) Save(instance string, body []byte) error {
+	var clientResponse ClientResponse
+
+	err := json.Unmarshal(body, &clientResponse)
+	if err != nil {
+		return fmt.Errorf("kubernetes %w", err)
+	}
+
+	secret := kubernetesSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Type:       "Opaque",
+		Data: map[string][]byte{
+			"client.json": body,
+			"client_id":   []byte(clientResponse.ClientID),
+		},
+	}
+	secret.Metadata.Name = s.secretName(instance)
+	secret.Metadata.Namespace = s.Namespace
+	secret.Metadata.Labels = map[string]string{
+		"app.kubernetes.io/managed-by": "dodas-IAMClientRec",
+	}
+
+	if clientResponse.ClientSecret != "" {
+		secret.Data["client_secret"] = []byte(clientResponse.ClientSecret)
+	}
+
+	resourceVersion, loaded := s.resourceVersions[instance]
+	secret.Metadata.ResourceVersion = resourceVersion
+
+	request, err := json.Marshal(secret)
+	if err != nil {
+		return fmt.Errorf("kubernetes %w", err)
+	}
+
+	var (
+		status int
+		rbody  []byte
+	)
+
+	if loaded {
+		status, rbody, err = s.request(http.MethodPut, s.url(secret.Metadata.Name), request)
+		if err != nil {
+			return err
+		}
+
+		if status == http.StatusConflict {
+			return fmt.Errorf("%w: %s", errStoreConflict, s.Location(instance))
+		}
+	} else {
+		status, rbody, err = s.request(http.MethodPost, s.url(""), request)
+		if err != nil {
+			return err
+		}
+
+		if status == http.StatusConflict {
+			status, rbody, err = s.request(http.MethodPut, s.url(secret.Metadata.Name), request)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if status != http.StatusOK && status != http.StatusCreated {
+		return kubernetesError(status, rbody)
+	}
+
+	var written kubernetesSecret
+
+	if json.Unmarshal(rbody, &written) == nil {
+		s.setResourceVersion(instance, written.Metadata.ResourceVersion)
+	} else {
+		delete(s.resourceVersions, instance)
+	}
+
+	return nil
+}
+
+// Delete removes the client Secret.
+func (s *KubernetesStore) Delete(instance string) error {
+	status, body, err := s.request(http.MethodDelete, s.url(s.secretName(instance)), nil)
+	if err != nil {
+		return err
+	}
+
+	delete(s.resourceVersions, instance)
+
+	switch status {
+	case http.StatusOK, http.StatusAccepted:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %s", errClientNotStored, s.Location(instance))
+	default:
+		return kubernetesError(status, body)
+	}
+}
+
+// Exists tells whether the client Secret is there.
+func (s *KubernetesStore) Exists(instance string) (bool, error) {
+	_, err := s.Load(instance)
+
+	switch {
+	case errors.Is(err, errClientNotStored):
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return true, nil
+	}
+}
+
+// Encrypted is false, the Secrets are protected by the cluster.
+func (s *KubernetesStore) Encrypted() bool {
+	return false
+}
+
+// Location is the namespace and the name of the client Secret.
+func (s *KubernetesStore) Location(instance string) string {
+	return fmt.Sprintf("kubernetes secret %s/%s", s.Namespace, s.secretName(instance))
+}
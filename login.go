@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gookit/color"
+	"github.com/rs/zerolog/log"
+)
+
+// LoginTimeout is how long the login waits for the authorization response.
+const LoginTimeout = 5 * time.Minute
+
+var (
+	errNoLoopbackRedirect = errors.New("no loopback redirect uri registered for the client")
+	errStateMismatch      = errors.New("the authorization response state does not match the request")
+	errNonceMismatch      = errors.New("the ID token nonce does not match the request")
+	errLoginTimeout       = errors.New("no authorization response received in time")
+)
+
+// randomString returns n random bytes, base64url encoded.
+func randomString(n int) (string, error) {
+	buff := make([]byte, n)
+
+	_, err := rand.Read(buff)
+	if err != nil {
+		return "", fmt.Errorf("random string %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buff), nil
+}
+
+// newPKCE returns a code verifier and its S256 code challenge (RFC 7636).
+func newPKCE() (verifier string, challenge string, err error) {
+	verifier, err = randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// loopbackRedirect returns the first registered redirect uri on the
+// loopback interface, where a local listener can receive the code.
+func loopbackRedirect(redirects []string) (*url.URL, error) {
+	for _, redirect := range redirects {
+		uri, err := url.Parse(redirect)
+		if err != nil || uri.Scheme != "http" {
+			continue
+		}
+
+		switch uri.Hostname() {
+		case "127.0.0.1", "localhost", "::1":
+			return uri, nil
+		}
+	}
+
+	return nil, errNoLoopbackRedirect
+}
+
+// openBrowser tries to open the URL in the browser of the user.
+func openBrowser(uri string) error {
+	var cmd *exec.Cmd
+
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", uri)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", uri)
+	default:
+		cmd = exec.Command("xdg-open", uri)
+	}
+
+	return cmd.Start()
+}
+
+type authorizationResponse struct {
+	code string
+	err  error
+}
+
+// listenRedirect binds the address of the loopback redirect uri.
+func listenRedirect(redirect *url.URL) (net.Listener, error) {
+	address := redirect.Host
+	if redirect.Port() == "" {
+		address = net.JoinHostPort(redirect.Hostname(), "80")
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("login listener %w", err)
+	}
+
+	return listener, nil
+}
+
+// waitAuthorizationCode serves the redirect uri on the listener until the
+// authorization response arrives.
+func waitAuthorizationCode(listener net.Listener, redirect *url.URL, state string) (code string, err error) {
+	path := redirect.Path
+	if path == "" {
+		path = "/"
+	}
+
+	result := make(chan authorizationResponse, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		var response authorizationResponse
+
+		switch {
+		case query.Get("error") != "":
+			response.err = &OAuthError{Code: query.Get("error"), Description: query.Get("error_description")}
+		case query.Get("state") != state:
+			response.err = errStateMismatch
+		default:
+			response.code = query.Get("code")
+		}
+
+		if response.err != nil {
+			http.Error(w, response.err.Error(), http.StatusBadRequest)
+		} else {
+			fmt.Fprintln(w, "Login completed, you can close this window.")
+		}
+
+		select {
+		case result <- response:
+		default:
+		}
+	})
+
+	server := &http.Server{Handler: mux}
+
+	go server.Serve(listener) // nolint: errcheck
+
+	defer server.Close()
+
+	select {
+	case response := <-result:
+		return response.code, response.err
+	case <-time.After(LoginTimeout):
+		return "", errLoginTimeout
+	}
+}
+
+// Login obtains a refresh token for the stored client with the
+// authorization code flow and PKCE, receiving the code on a loopback
+// redirect uri, and stores it with the client.
+func (t *InitClientConfig) Login(instance string) (token TokenResponse, err error) {
+	clientResponse, passwd, err := t.LoadClient(instance)
+	if err != nil {
+		return token, err
+	}
+
+	provider, err := t.Discover(clientResponse.IssuerEndpoint())
+	if err != nil {
+		return token, err
+	}
+
+	authorizationEndpoint, err := requireEndpoint("authorization_endpoint", provider.AuthorizationEndpoint)
+	if err != nil {
+		return token, err
+	}
+
+	tokenEndpoint, err := requireEndpoint("token_endpoint", provider.TokenEndpoint)
+	if err != nil {
+		return token, err
+	}
+
+	redirect, err := loopbackRedirect(clientResponse.RedirectURIs)
+	if err != nil {
+		return token, err
+	}
+
+	// listen before showing the URL, the redirect may come back quickly
+	listener, err := listenRedirect(redirect)
+	if err != nil {
+		return token, err
+	}
+
+	defer listener.Close()
+
+	verifier, challenge, err := newPKCE()
+	if err != nil {
+		return token, err
+	}
+
+	state, err := randomString(16)
+	if err != nil {
+		return token, err
+	}
+
+	nonce, err := randomString(16)
+	if err != nil {
+		return token, err
+	}
+
+	scope := clientResponse.Scope
+	if scope == "" {
+		scope = "openid"
+	}
+
+	authorization, err := url.Parse(authorizationEndpoint)
+	if err != nil {
+		return token, fmt.Errorf("login %w", err)
+	}
+
+	query := authorization.Query()
+	query.Set("response_type", ResponseCode)
+	query.Set("client_id", clientResponse.ClientID)
+	query.Set("redirect_uri", redirect.String())
+	query.Set("scope", scope)
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", challenge)
+	query.Set("code_challenge_method", "S256")
+	authorization.RawQuery = query.Encode()
+
+	color.Green.Printf("==> Open the following URL to log in:\n%s\n", authorization.String())
+
+	if errBrowser := openBrowser(authorization.String()); errBrowser != nil {
+		log.Debug().Err(errBrowser).Msg("login - cannot open the browser")
+	}
+
+	code, err := waitAuthorizationCode(listener, redirect, state)
+	if err != nil {
+		return token, err
+	}
+
+	token, err = t.TokenRequest(tokenEndpoint, clientResponse, url.Values{
+		"grant_type":    {GrantAuthorizationCode},
+		"code":          {code},
+		"redirect_uri":  {redirect.String()},
+		"code_verifier": {verifier},
+	})
+	if err != nil {
+		return token, err
+	}
+
+	if token.IDToken != "" {
+		_, claims, err := DecodeJWT(token.IDToken)
+		if err != nil {
+			return token, fmt.Errorf("login id token %w", err)
+		}
+
+		if claims["nonce"] != nonce {
+			return token, errNonceMismatch
+		}
+	}
+
+	_, err = t.storeTokens(instance, clientResponse, passwd, token)
+
+	return token, err
+}
+
+// warnRefreshToken warns when the login issued no refresh token, or when it
+// is stored unencrypted.
+func (t *InitClientConfig) warnRefreshToken(instance string, token TokenResponse) {
+	switch {
+	case token.RefreshToken == "":
+		color.Yellow.Println("==> Warning: no refresh token issued, is the offline_access scope granted?")
+	case plaintextStore(t.store()):
+		color.Yellow.Printf("==> Warning: the refresh token is stored unencrypted in %s, "+
+			"set CLIENT_STORE=encrypted-file, keyring, vault or kubernetes to protect it\n", t.store().Location(instance))
+	}
+}
+
+func loginOperation(clientIAM *InitClientConfig, instance string, args []string) error {
+	var output tokenOutput
+
+	flags := flag.NewFlagSet("login", flag.ContinueOnError)
+	output.register(flags)
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() > 0 {
+		return fmt.Errorf("%w: %s", errTooManyArgs, strings.Join(flags.Args(), " "))
+	}
+
+	token, err := clientIAM.Login(instance)
+	if err != nil {
+		return err
+	}
+
+	clientIAM.warnRefreshToken(instance, token)
+
+	color.Green.Printf("==> Client %s logged in\n", instance)
+
+	_, err = output.write(token.AccessToken)
+
+	return err
+}
@@ -3,20 +3,22 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
-	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
-	"text/template"
 
 	"github.com/awnumar/memguard"
 	"github.com/denisbrodbeck/machineid"
@@ -24,34 +26,6 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-type WellKnown struct {
-	RegisterEndpoint string `json:"registration_endpoint"`
-}
-
-func GetRegisterEndpoint(endpoint string) (register_endpoint string){
-	var c http.Client
-	well_known := endpoint + "/.well-known/openid-configuration"
-	resp, err := c.Get(well_known)
-
-	if err != nil {
-		panic(err)
-	}
-
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-
-	var wk WellKnown
-
-	errUnmarshall := json.Unmarshal(body, &wk)
-
-	if errUnmarshall != nil {
-		panic(errUnmarshall)
-	}
-
-	return string(wk.RegisterEndpoint)
-}
-
 func tryContainerMachineID() (machineID string, err error) {
 	// Ref: https://stackoverflow.com/questions/23513045/how-to-check-if-a-process-is-running-inside-docker-container
 	cgroupFile, err := os.Open("/proc/self/cgroup")
@@ -88,7 +62,9 @@ func tryContainerMachineID() (machineID string, err error) {
 	return machineID, nil
 }
 
-func CreateHash(key string) string {
+// CreateHash returns the HMAC of the key with the machine id, the encryption
+// key of the legacy client files.
+func CreateHash(key string) (string, error) {
 	log.Debug().Msg("create hash")
 
 	id, errID := machineid.ProtectedID("sts-wire")
@@ -105,7 +81,7 @@ func CreateHash(key string) string {
 				log.Debug().Str("machineID", id).Msg("Found docker container id")
 			}
 		} else {
-			panic(errID)
+			return "", fmt.Errorf("machine id %w", errID)
 		}
 	}
 
@@ -113,88 +89,135 @@ func CreateHash(key string) string {
 	_, errWrite := hasher.Write([]byte(key))
 
 	if errWrite != nil {
-		panic(errWrite)
+		return "", fmt.Errorf("hash %w", errWrite)
 	}
 
-	return hex.EncodeToString(hasher.Sum(nil))
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
-func Encrypt(data []byte, password *memguard.Enclave) []byte {
+// Encrypt seals the data with AES-GCM, with a key derived from the password
+// with Argon2id and a random salt, after a header recording the format
+// version, the key derivation parameters and the endpoint. The header and
+// the instance name are authenticated with the data.
+func Encrypt(data []byte, password *memguard.Enclave, instance string, endpoint string) ([]byte, error) {
 	log.Debug().Msg("encryption - open enclave")
 
-	passphrase, errOpenEnclave := password.Open()
-	if errOpenEnclave != nil {
-		memguard.SafePanic(errOpenEnclave)
+	passphrase, err := password.Open()
+	if err != nil {
+		return nil, fmt.Errorf("encryption %w", err)
 	}
 
 	defer passphrase.Destroy() // Destroy the copy when we return
 
+	log.Debug().Msg("encryption - derive key")
+
+	params, err := DefaultKDFParams()
+	if err != nil {
+		return nil, err
+	}
+
+	header := encryptedHeader{
+		Version:  encryptedVersion,
+		Params:   params,
+		Endpoint: endpoint,
+	}
+
 	log.Debug().Msg("encryption - create cipher")
 
-	block, errNewCiper := aes.NewCipher([]byte(CreateHash(string(passphrase.Bytes()))))
-	if errNewCiper != nil {
-		panic(errNewCiper)
+	block, err := aes.NewCipher(params.Key(passphrase.Bytes()))
+	if err != nil {
+		return nil, fmt.Errorf("encryption %w", err)
 	}
 
 	log.Debug().Msg("encryption - create block")
 
-	gcm, errNewGCM := cipher.NewGCM(block)
-	if errNewGCM != nil {
-		panic(errNewGCM.Error())
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("encryption %w", err)
 	}
 
 	nonce := make([]byte, gcm.NonceSize())
 
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		panic(err.Error())
+		return nil, fmt.Errorf("encryption %w", err)
 	}
 
 	log.Debug().Msg("encryption - encode")
 
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
+	ciphertext := gcm.Seal(append(header.encode(), nonce...), nonce, data, header.associatedData(instance))
 
-	return ciphertext
+	return ciphertext, nil
 }
 
-func Decrypt(data []byte, password *memguard.Enclave) []byte {
+// Decrypt opens the data sealed by Encrypt for the instance and returns the
+// endpoint recorded with it. The files of the previous formats are opened
+// too: the version 1 ones, without associated data, and the legacy ones
+// without header, whose key is the CreateHash of the password.
+func Decrypt(data []byte, password *memguard.Enclave, instance string) (plaintext []byte, endpoint string, err error) {
 	log.Debug().Msg("decryption - open enclave")
 
-	passphrase, errOpenEnclave := password.Open()
-	if errOpenEnclave != nil {
-		memguard.SafePanic(errOpenEnclave)
+	passphrase, err := password.Open()
+	if err != nil {
+		return nil, "", fmt.Errorf("decryption %w", err)
 	}
 
 	defer passphrase.Destroy() // Destroy the copy when we return
 
 	log.Debug().Msg("decryption - create key")
 
-	key := []byte(CreateHash(string(passphrase.Bytes())))
+	var (
+		key            []byte
+		associatedData []byte
+	)
+
+	if isLegacyEncrypted(data) {
+		hash, err := CreateHash(string(passphrase.Bytes()))
+		if err != nil {
+			return nil, "", fmt.Errorf("decryption %w", err)
+		}
+
+		key = []byte(hash)
+	} else {
+		header, rest, err := decodeHeader(data)
+		if err != nil {
+			return nil, "", err
+		}
+
+		key = header.Params.Key(passphrase.Bytes())
+		associatedData = header.associatedData(instance)
+		endpoint = header.Endpoint
+		data = rest
+	}
 
 	log.Debug().Msg("decryption - create cipher")
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err.Error())
+		return nil, "", fmt.Errorf("decryption %w", err)
 	}
 
 	log.Debug().Msg("decryption - create block")
 
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		panic(err.Error())
+		return nil, "", fmt.Errorf("decryption %w", err)
 	}
 
 	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, "", fmt.Errorf("%w: truncated", errEncryptedFormat)
+	}
+
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
 
 	log.Debug().Msg("decryption - decode")
 
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err = gcm.Open(nil, nonce, ciphertext, associatedData)
 	if err != nil {
-		panic(err.Error())
+		return nil, "", errDecrypt
 	}
 
-	return plaintext
+	return plaintext, endpoint, nil
 }
 
 type IAMClientConfig struct {
@@ -205,9 +228,45 @@ type IAMClientConfig struct {
 }
 
 type ClientResponse struct {
-	ClientID     string `json:"client_id"`
-	ClientSecret string `json:"client_secret"`
-	Endpoint     string `json:"registration_client_uri"`
+	ClientID                string   `json:"client_id"`
+	ClientSecret            string   `json:"client_secret"`
+	Endpoint                string   `json:"registration_client_uri"`
+	RegistrationAccessToken string   `json:"registration_access_token"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types"`
+	Scope                   string   `json:"scope"`
+	// Local fields, stored together with the registration response: the
+	// issuer the client is registered at, the PEM encoded key of the
+	// private_key_jwt clients and the tokens obtained with them
+	Issuer       string `json:"issuer,omitempty"`
+	PrivateKey   string `json:"private_key,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// AccessToken is cached until AccessTokenExpiresAt (unix time)
+	AccessToken          string `json:"access_token,omitempty"`
+	AccessTokenExpiresAt int64  `json:"access_token_expires_at,omitempty"`
+
+	// raw is the stored document the client was decoded from
+	raw []byte
+}
+
+// IssuerEndpoint returns the IAM endpoint the client is registered at.
+func (c ClientResponse) IssuerEndpoint() string {
+	if c.Issuer != "" {
+		return c.Issuer
+	}
+
+	// Clients stored before the issuer was recorded
+	return strings.Split(c.Endpoint, "/register")[0]
+}
+
+// Key returns the private key of the client, nil for clients without one.
+func (c ClientResponse) Key() (crypto.Signer, error) {
+	if c.PrivateKey == "" {
+		return nil, nil
+	}
+
+	return ParsePrivateKey([]byte(c.PrivateKey))
 }
 
 type InitClientConfig struct {
@@ -216,160 +275,485 @@ type InitClientConfig struct {
 	Scanner        GetInputWrapper
 	HTTPClient     http.Client
 	IAMServer      string
-	ClientTemplate string
+	ClientTemplate ClientMetadata
 	NoPWD          bool
+	// InitialAccessToken authorizes the registration on protected
+	// registration endpoints (RFC 7591, section 3)
+	InitialAccessToken string
+	// SoftwareStatement is a pre-signed software statement sent with the
+	// registration, otherwise one is signed with SoftwareStatementKey
+	SoftwareStatement       string
+	SoftwareStatementKey    crypto.Signer
+	SoftwareStatementIssuer string
+	// ClientKeyType selects the private_key_jwt authentication, with a
+	// generated "rsa" or "ec" key, instead of a client secret
+	ClientKeyType string
+	// CacheDir keeps the discovery documents between runs, when not empty
+	CacheDir string
+	// CapabilityCheck is the CapabilityWarn, CapabilityDrop or
+	// CapabilityFail handling of the values the provider does not support
+	CapabilityCheck string
+	// Store keeps the clients, the files in ConfDir when nil, encrypted
+	// unless NoPWD
+	Store ClientStore
 }
 
-func (t *InitClientConfig) InitClient(instance string) (endpoint string, clientResponse ClientResponse, passwd *memguard.Enclave, err error) { //nolint:funlen,gocognit,lll
-	filename := t.ConfDir + "/" + instance + ".json"
+func (t *InitClientConfig) store() ClientStore {
+	switch {
+	case t.Store != nil:
+		return t.Store
+	case t.NoPWD:
+		return FileStore{Dir: t.ConfDir}
+	default:
+		return EncryptedFileStore{FileStore{Dir: t.ConfDir}}
+	}
+}
 
-	log.Debug().Str("filename", filename).Msg("credentials - init client")
+// SaveClient dumps the registration response of the instance in the
+// client store, encrypted with passwd when one is given.
+func (t *InitClientConfig) SaveClient(instance string, body []byte, passwd *memguard.Enclave) error {
+	store := t.store()
 
-	confFile, err := os.Open(filename)
+	log.Debug().Str("store", store.Location(instance)).Msg("credentials - dump client")
 
-	switch {
-	case err != nil && err.Error() != "no such file or directory":
-		tmpl, errParser := template.New("client").Parse(t.ClientTemplate)
-		if errParser != nil {
-			panic(errParser)
+	dumpClient := body
+
+	if passwd != nil {
+		var clientResponse ClientResponse
+
+		err := json.Unmarshal(body, &clientResponse)
+		if err != nil {
+			return fmt.Errorf("dump client %w", err)
+		}
+
+		dumpClient, err = Encrypt(body, passwd, instance, clientResponse.IssuerEndpoint())
+		if err != nil {
+			return fmt.Errorf("dump client %w", err)
 		}
+	}
+
+	err := store.Save(instance, dumpClient)
+	if err != nil {
+		return fmt.Errorf("dump client %w", err)
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes to a temporary file in the same directory first and
+// renames it, so that the file is never left half written.
+func writeFileAtomic(filename string, content []byte, perm os.FileMode) error {
+	curFile, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+"-*")
+	if err != nil {
+		return err
+	}
 
-		var b bytes.Buffer
-		errExecute := tmpl.Execute(&b, t.ClientConfig)
+	defer os.Remove(curFile.Name())
 
-		if errExecute != nil {
-			panic(errExecute)
+	_, err = curFile.Write(content)
+	if err != nil {
+		curFile.Close()
+
+		return err
+	}
+
+	err = curFile.Chmod(perm)
+	if err != nil {
+		curFile.Close()
+
+		return err
+	}
+
+	// Flush the content before the rename, so that a crash leaves the old
+	// file or the new one, never an empty one
+	err = curFile.Sync()
+	if err != nil {
+		curFile.Close()
+
+		return err
+	}
+
+	err = curFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(curFile.Name(), filename)
+}
+
+// LoadClient reads back the client stored by SaveClient, asking for the
+// decryption password when needed.
+func (t *InitClientConfig) LoadClient(instance string) (clientResponse ClientResponse, passwd *memguard.Enclave, err error) {
+	store := t.store()
+
+	log.Debug().Str("store", store.Location(instance)).Msg("credentials - load client")
+
+	body, err := store.Load(instance)
+	if err != nil {
+		return clientResponse, nil, fmt.Errorf("load client %w", err)
+	}
+
+	if !store.Encrypted() && !isLegacyEncrypted(body) {
+		return clientResponse, nil, fmt.Errorf("load client %w", errClientEncrypted)
+	}
+
+	if store.Encrypted() {
+		// TODO: verify branch when REFRESH_TOKEN is passed and is not empty string
+		if os.Getenv("REFRESH_TOKEN") == "" {
+			passMsg := fmt.Sprintf("%s Insert a pasword for the secret's decryption: ", color.Yellow.Sprint("==>"))
+			passwd, err = t.Scanner.GetPassword(passMsg, true)
+
+			if err != nil {
+				return clientResponse, nil, fmt.Errorf("load client %w", err)
+			}
+		} else {
+			passwd = memguard.NewEnclave([]byte("nopassword"))
 		}
 
-		request := b.String()
+		migrate := needsMigration(body)
 
-		log.Debug().Str("URL", request).Msg("credentials")
+		var endpoint string
+
+		body, endpoint, err = Decrypt(body, passwd, instance)
+		if err != nil {
+			return clientResponse, nil, fmt.Errorf("load client %w", err)
+		}
 
-		contentType := "application/json"
+		if endpoint != "" && t.IAMServer != "" &&
+			strings.TrimSuffix(endpoint, "/") != strings.TrimSuffix(t.IAMServer, "/") {
+			return clientResponse, nil, fmt.Errorf("%w: %s, not %s", errEndpointMismatch, endpoint, t.IAMServer)
+		}
 
-		log.Debug().Str("REFRESH_TOKEN", os.Getenv("REFRESH_TOKEN")).Msg("credentials")
+		// Move the files of the previous formats to the current one, now
+		// that the password is known to be right
+		if migrate {
+			log.Debug().Str("store", store.Location(instance)).Msg("credentials - migrate client")
 
-		if t.IAMServer == "" {
-			endpoint, err = t.Scanner.GetInputString("Insert the IAM endpoint",
-				"https://iam-demo.cloud.cnaf.infn.it")
+			err = t.SaveClient(instance, body, passwd)
 			if err != nil {
-				panic(err)
+				return clientResponse, nil, fmt.Errorf("migrate client %w", err)
 			}
-		} else if t.IAMServer != "" {
-			log.Debug().Str("IAM endpoint used", t.IAMServer).Msg("credentials")
-			color.Green.Printf("==> IAM endpoint used: %s\n", t.IAMServer)
-			endpoint = t.IAMServer
 		}
+	}
+
+	err = json.Unmarshal(body, &clientResponse)
+	if err != nil {
+		return clientResponse, nil, fmt.Errorf("load client %w", err)
+	}
+
+	clientResponse.raw = body
+
+	return clientResponse, passwd, nil
+}
+
+// mergeClientFields sets the fields in the client document, removing the
+// ones with an empty value.
+func mergeClientFields(body []byte, fields map[string]interface{}) ([]byte, error) {
+	var document map[string]interface{}
+
+	err := json.Unmarshal(body, &document)
+	if err != nil {
+		return nil, fmt.Errorf("merge client fields %w", err)
+	}
+
+	for key, value := range fields {
+		if value == "" || value == nil {
+			delete(document, key)
+		} else {
+			document[key] = value
+		}
+	}
+
+	content, err := json.Marshal(document)
+	if err != nil {
+		return nil, fmt.Errorf("merge client fields %w", err)
+	}
+
+	return content, nil
+}
+
+// UpdateStoredClient changes the fields of a client loaded with LoadClient
+// and stores it again.
+func (t *InitClientConfig) UpdateStoredClient(instance string, clientResponse ClientResponse, passwd *memguard.Enclave, fields map[string]interface{}) (ClientResponse, error) { //nolint:lll
+	body, err := mergeClientFields(clientResponse.raw, fields)
+	if err != nil {
+		return clientResponse, err
+	}
+
+	var updated ClientResponse
+
+	err = json.Unmarshal(body, &updated)
+	if err != nil {
+		return clientResponse, fmt.Errorf("update stored client %w", err)
+	}
+
+	updated.raw = body
+
+	err = t.SaveClient(instance, body, passwd)
+	if err != nil {
+		return clientResponse, err
+	}
+
+	return updated, nil
+}
+
+// ClientRequest builds the registration request from the client template
+// and the client configuration. When clientKey is given, its public part is
+// registered for the private_key_jwt authentication. When provider is given,
+// the request is checked against its capabilities.
+func (t *InitClientConfig) ClientRequest(clientKey crypto.Signer, provider *ProviderMetadata) ([]byte, error) {
+	metadata := t.ClientTemplate
+
+	if clientKey != nil {
+		jwk, err := PublicJWK(clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("client request %w", err)
+		}
+
+		jwks, err := json.Marshal(map[string][]JWK{"keys": {jwk}})
+		if err != nil {
+			return nil, fmt.Errorf("client request %w", err)
+		}
+
+		metadata.TokenEndpointAuthMethod = AuthPrivateKeyJWT
+		metadata.Jwks = jwks
+		metadata.JwksURI = ""
+	}
 
-		register := GetRegisterEndpoint(endpoint)
+	if len(metadata.RedirectURIs) == 0 && t.ClientConfig.CallbackURL != "" {
+		metadata.RedirectURIs = []string{t.ClientConfig.CallbackURL}
+	}
+
+	if metadata.ClientName == "" {
+		metadata.ClientName = t.ClientConfig.ClientName
+	}
 
-		log.Debug().Str("IAM register url", register).Msg("credentials")
-		color.Green.Printf("==> IAM register url: %s\n", register)
+	if provider != nil {
+		var err error
 
-		resp, err := t.HTTPClient.Post(register, contentType, strings.NewReader(request))
+		metadata, err = NegotiateCapabilities(metadata, provider, t.CapabilityCheck)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("client request %w", err)
 		}
+	}
+
+	switch {
+	case t.SoftwareStatement != "":
+		metadata.SoftwareStatement = t.SoftwareStatement
+	case t.SoftwareStatementKey != nil:
+		statement, err := metadata.SignSoftwareStatement(t.SoftwareStatementKey, t.SoftwareStatementIssuer)
+		if err != nil {
+			return nil, fmt.Errorf("client request %w", err)
+		}
+
+		metadata.SoftwareStatement = statement
+	}
 
-		defer resp.Body.Close()
+	err := metadata.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("client request %w", err)
+	}
 
-		log.Debug().Int("StatusCode", resp.StatusCode).Str("Status", resp.Status).Msg("credentials")
+	request, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("client request %w", err)
+	}
 
-		var rbody bytes.Buffer
+	return request, nil
+}
+
+// register sends the registration request to the IAM endpoint and stores
+// the registered client.
+func (t *InitClientConfig) register(instance string) (endpoint string, clientResponse ClientResponse, passwd *memguard.Enclave, err error) { //nolint:funlen,gocognit,lll
+	var clientKey crypto.Signer
 
-		_, err = rbody.ReadFrom(resp.Body)
+	if t.ClientKeyType != "" {
+		log.Debug().Str("key type", t.ClientKeyType).Msg("credentials - generate client key")
+
+		clientKey, err = GenerateKey(t.ClientKeyType)
 		if err != nil {
-			log.Err(err).Msg("credentials - read body")
-			panic(err)
+			return endpoint, clientResponse, nil, err
 		}
+	}
 
-		log.Debug().Str("body", rbody.String()).Msg("credentials")
+	contentType := "application/json"
 
-		errUnmarshall := json.Unmarshal(rbody.Bytes(), &clientResponse)
-		if errUnmarshall != nil {
-			panic(errUnmarshall)
+	log.Debug().Str("REFRESH_TOKEN", os.Getenv("REFRESH_TOKEN")).Msg("credentials")
+
+	if t.IAMServer == "" {
+		endpoint, err = t.Scanner.GetInputString("Insert the IAM endpoint",
+			"https://iam-demo.cloud.cnaf.infn.it")
+		if err != nil {
+			return endpoint, clientResponse, nil, err
 		}
+	} else if t.IAMServer != "" {
+		log.Debug().Str("IAM endpoint used", t.IAMServer).Msg("credentials")
+		color.Green.Printf("==> IAM endpoint used: %s\n", t.IAMServer)
+		endpoint = t.IAMServer
+	}
 
-		clientResponse.Endpoint = endpoint
+	provider, err := t.Discover(endpoint)
+	if err != nil {
+		return endpoint, clientResponse, nil, err
+	}
 
-		if !t.NoPWD { //nolint:nestif
-			var errGetPasswd error
+	register, err := requireEndpoint("registration_endpoint", provider.RegistrationEndpoint)
+	if err != nil {
+		return endpoint, clientResponse, nil, err
+	}
 
-			// TODO: verify branch when REFRESH_TOKEN is passed and is not empty string
-			if os.Getenv("REFRESH_TOKEN") == "" {
-				passMsg := fmt.Sprintf("%s Insert a pasword for the secret's encryption: ", color.Yellow.Sprint("==>"))
-				passwd, errGetPasswd = t.Scanner.GetPassword(passMsg, false)
+	request, err := t.ClientRequest(clientKey, provider)
+	if err != nil {
+		return endpoint, clientResponse, nil, err
+	}
 
-				if errGetPasswd != nil {
-					panic(errGetPasswd)
-				}
-			} else {
-				passwd = memguard.NewEnclave([]byte("nopassword"))
-			}
+	log.Debug().Bytes("URL", request).Msg("credentials")
 
-			dumpClient := Encrypt(rbody.Bytes(), passwd)
+	log.Debug().Str("IAM register url", register).Msg("credentials")
+	color.Green.Printf("==> IAM register url: %s\n", register)
 
-			filename := t.ConfDir + "/" + instance + ".json"
+	req, err := http.NewRequest(http.MethodPost, register, bytes.NewReader(request))
+	if err != nil {
+		return endpoint, clientResponse, nil, fmt.Errorf("registration request %w", err)
+	}
 
-			curFile, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-			if err != nil {
-				log.Err(err).Msg("credentials - dump client")
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json")
 
-				panic(err)
-			}
+	if t.InitialAccessToken != "" {
+		log.Debug().Msg("credentials - using initial access token")
+		req.Header.Set("Authorization", "Bearer "+t.InitialAccessToken)
+	}
 
-			_, err = curFile.Write(dumpClient)
-			if err != nil {
-				log.Err(err).Msg("credentials - dump client")
+	resp, err := t.HTTPClient.Do(req)
+	if err != nil {
+		return endpoint, clientResponse, nil, fmt.Errorf("%w: %s", errHTTP, err)
+	}
 
-				panic(err)
-			}
+	defer resp.Body.Close()
 
-			err = curFile.Close()
-			if err != nil {
-				log.Err(err).Msg("credentials - dump client")
+	log.Debug().Int("StatusCode", resp.StatusCode).Str("Status", resp.Status).Msg("credentials")
 
-				panic(err)
-			}
-		}
-	case err == nil && !t.NoPWD:
-		var errGetPasswd error
-		defer confFile.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		err = unauthorizedRegistration(t.InitialAccessToken != "", resp.Header.Get("WWW-Authenticate"))
+		log.Err(err).Msg("credentials")
+
+		return endpoint, clientResponse, nil, err
+	}
+
+	var rbody bytes.Buffer
+
+	_, err = rbody.ReadFrom(resp.Body)
+	if err != nil {
+		log.Err(err).Msg("credentials - read body")
+
+		return endpoint, clientResponse, nil, fmt.Errorf("%w: %s", errHTTP, err)
+	}
+
+	log.Debug().Str("body", rbody.String()).Msg("credentials")
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		err = responseError(resp.StatusCode, rbody.Bytes())
+		log.Err(err).Msg("credentials")
+
+		return endpoint, clientResponse, nil, err
+	}
+
+	err = json.Unmarshal(rbody.Bytes(), &clientResponse)
+	if err != nil {
+		return endpoint, clientResponse, nil, fmt.Errorf("%w: invalid registration response: %s", errHTTP, err)
+	}
 
-		var rbody bytes.Buffer
+	if clientResponse.ClientID == "" {
+		return endpoint, clientResponse, nil, fmt.Errorf("%w: no client_id in the registration response", errHTTP)
+	}
 
-		_, err = rbody.ReadFrom(confFile)
+	clientResponse.Issuer = provider.Issuer
+
+	if clientKey != nil {
+		clientResponse.PrivateKey, err = EncodePrivateKey(clientKey)
 		if err != nil {
-			log.Err(err).Msg("credentials - init client")
-			panic(err)
+			return endpoint, clientResponse, nil, err
 		}
+	}
+
+	clientResponse.raw, err = mergeClientFields(rbody.Bytes(), map[string]interface{}{
+		"issuer":      clientResponse.Issuer,
+		"private_key": clientResponse.PrivateKey,
+	})
+	if err != nil {
+		return endpoint, clientResponse, nil, err
+	}
 
+	if t.store().Encrypted() {
 		// TODO: verify branch when REFRESH_TOKEN is passed and is not empty string
 		if os.Getenv("REFRESH_TOKEN") == "" {
-			passMsg := fmt.Sprintf("%s Insert a pasword for the secret's decryption: ", color.Yellow.Sprint("==>"))
-			passwd, errGetPasswd = t.Scanner.GetPassword(passMsg, true)
+			passMsg := fmt.Sprintf("%s Insert a pasword for the secret's encryption: ", color.Yellow.Sprint("==>"))
+			passwd, err = t.Scanner.GetPassword(passMsg, false)
 
-			if errGetPasswd != nil {
-				panic(errGetPasswd)
+			if err != nil {
+				return endpoint, clientResponse, nil, err
 			}
 		} else {
 			passwd = memguard.NewEnclave([]byte("nopassword"))
 		}
+	}
+
+	err = t.SaveClient(instance, clientResponse.raw, passwd)
+	if err != nil {
+		log.Err(err).Msg("credentials - dump client")
+
+		return endpoint, clientResponse, nil, err
+	}
+
+	err = checkDowngrade(request, rbody.Bytes())
+	if err != nil {
+		log.Warn().Err(err).Msg("credentials")
 
-		errUnmarshal := json.Unmarshal(Decrypt(rbody.Bytes(), passwd), &clientResponse)
-		if errUnmarshal != nil {
-			panic(errUnmarshal)
+		if t.CapabilityCheck == CapabilityFail {
+			return endpoint, clientResponse, nil, fmt.Errorf("%w (client %s stored, remove it with delete)",
+				err, clientResponse.ClientID)
+		}
+
+		color.Yellow.Printf("==> Warning: %s\n", err)
+	}
+
+	return endpoint, clientResponse, passwd, nil
+}
+
+// InitClient loads the client stored for the instance, registering a new
+// one when there is none.
+func (t *InitClientConfig) InitClient(instance string) (endpoint string, clientResponse ClientResponse, passwd *memguard.Enclave, err error) {
+	store := t.store()
+
+	log.Debug().Str("store", store.Location(instance)).Msg("credentials - init client")
+
+	exists, err := store.Exists(instance)
+
+	switch {
+	case err == nil && !exists:
+		endpoint, clientResponse, passwd, err = t.register(instance)
+		if err != nil {
+			return endpoint, clientResponse, nil, err
+		}
+	case err == nil:
+		clientResponse, passwd, err = t.LoadClient(instance)
+		if err != nil {
+			log.Err(err).Msg("credentials - init client")
+
+			return endpoint, clientResponse, nil, err
 		}
 
 		log.Debug().Str("response endpoint", clientResponse.Endpoint).Msg("credentials")
-		endpoint = strings.Split(clientResponse.Endpoint, "/register")[0]
+		endpoint = clientResponse.IssuerEndpoint()
 	default:
 		log.Err(err).Msg("credentials - init client")
-		panic(err)
+
+		return endpoint, clientResponse, nil, fmt.Errorf("init client %w", err)
 	}
 
 	if endpoint == "" {
-		panic("Something went wrong. No endpoint selected")
+		return endpoint, clientResponse, nil, errNoEndpoint
 	}
 
 	return endpoint, clientResponse, passwd, nil
@@ -405,17 +789,71 @@ func (t *GetInputWrapper) GetInputString(question string, def string) (text stri
 	return text, nil
 }
 
+// envOrFile reads a value from the environment variable name, or from the
+// file given by the name_FILE variable.
+func envOrFile(name string) (string, error) {
+	if value := os.Getenv(name); value != "" {
+		return value, nil
+	}
+
+	filename := os.Getenv(name + "_FILE")
+	if filename == "" {
+		return "", nil
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("read %s %w", name, err)
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// operations are the commands that act on an already registered client,
+// invoked as "dodas-IAMClientRec <operation> <client name> [options]".
+var operations = map[string]func(clientIAM *InitClientConfig, instance string, args []string) error{
+	"show":       showOperation,
+	"update":     updateOperation,
+	"delete":     deleteOperation,
+	"rotate":     rotateOperation,
+	"login":      loginOperation,
+	"device":     deviceOperation,
+	"token":      tokenOperation,
+	"exchange":   exchangeOperation,
+	"introspect": introspectOperation,
+	"revoke":     revokeOperation,
+	"decode":     decodeOperation,
+	"userinfo":   userinfoOperation,
+}
+
 func main() {
 	inputReader := *bufio.NewReader(os.Stdin)
 	scanner := GetInputWrapper{
 		Scanner: inputReader,
 	}
 
+	args := os.Args[1:]
+
+	operation := ""
+	if len(args) > 0 {
+		if _, ok := operations[args[0]]; ok {
+			operation = args[0]
+			args = args[1:]
+		}
+	}
+
 	instance := ""
-	if len(os.Args) > 1 {
-		instance = os.Args[1]
+	if len(args) > 0 {
+		instance = args[0]
 		if instance == "-h" {
 			fmt.Println("dodas-IAMClientRec <client name>")
+			fmt.Println("dodas-IAMClientRec show|update|delete|rotate <client name>")
+			fmt.Println("dodas-IAMClientRec login|device <client name> [-o file] [-bearer]")
+			fmt.Println("dodas-IAMClientRec token <client name> [-scope scopes] [-audience aud] [-o file] [-bearer]")
+			fmt.Println("dodas-IAMClientRec exchange <client name> [-audience aud] [-scope scopes] [-o file] [-bearer] [subject token]")
+			fmt.Println("dodas-IAMClientRec introspect|revoke <client name> [-hint access_token|refresh_token] [token]")
+			fmt.Println("dodas-IAMClientRec decode <client name> [-audience aud] [token]")
+			fmt.Println("dodas-IAMClientRec userinfo <client name> [-json] [token]")
 			return
 		} else if instance == "" {
 			instance = "automatic"
@@ -428,20 +866,41 @@ func main() {
 
 	iamServer = os.Getenv("IAM_INSTANCE")
 
-	if iamServer == "" {
-		if len(os.Args) > 2 {
-			iamServer = os.Args[2]
+	if iamServer == "" && operation == "" {
+		if len(args) > 1 {
+			iamServer = args[1]
 		}
 	}
-	if iamServer == "" {
+	if iamServer == "" && operation == "" {
 		fmt.Println("No IAM instance specified, please set env IAM_INSTANCE or use:")
 		fmt.Println("dodas-IAMClientRec <client name> <IAM instance>")
 		return
 	}
 
 	callback := os.Getenv("OAUTH_CALLBACK")
+	templateFile := os.Getenv("CLIENT_TEMPLATE")
+	overlayFiles := filepath.SplitList(os.Getenv("CLIENT_OVERLAY"))
+
+	profile := os.Getenv("CLIENT_PROFILE")
+	if profile == "" {
+		profile = "confidential"
+	}
+
+	clientTemplate, ok := ClientProfiles[profile]
+	if !ok {
+		var profiles []string
+		for name := range ClientProfiles {
+			profiles = append(profiles, name)
+		}
 
-	if callback == "" {
+		sort.Strings(profiles)
+
+		fmt.Printf("Unknown client profile %q, please use one of: %s\n", profile, strings.Join(profiles, ", "))
+		return
+	}
+
+	if callback == "" && clientTemplate.NeedsRedirect() && templateFile == "" && len(overlayFiles) == 0 &&
+		(operation == "" || operation == "update") {
 		fmt.Println("No Service redirect callback url specified, please set env OAUTH_CALLBACK")
 		return
 	}
@@ -458,42 +917,108 @@ func main() {
 		ClientName:  instance,
 	}
 
-	// Create a CA certificate pool and add cert.pem to it
-	//caCert, err := ioutil.ReadFile("MINIO.pem")
-	//if err != nil {
-	//	log.Fatal(err)
-	//}
-	//caCertPool := x509.NewCertPool()
-	//caCertPool.AppendCertsFromPEM(caCert)
+	initialAccessToken, err := envOrFile("IAM_INITIAL_ACCESS_TOKEN")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s\n", color.Red.Sprint("[X]==>"), err)
+		os.Exit(1)
+	}
+
+	softwareStatement, err := envOrFile("SOFTWARE_STATEMENT")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s\n", color.Red.Sprint("[X]==>"), err)
+		os.Exit(1)
+	}
+
+	var softwareStatementKey crypto.Signer
 
-	// Create the TLS Config with the CA pool and enable Client certificate validation
-	cfg := &tls.Config{
-		//ClientCAs: caCertPool,
-		InsecureSkipVerify: true,
+	if keyFile := os.Getenv("SOFTWARE_STATEMENT_KEY"); keyFile != "" {
+		softwareStatementKey, err = LoadPrivateKey(keyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s %s\n", color.Red.Sprint("[X]==>"), err)
+			os.Exit(1)
+		}
 	}
-	//cfg.BuildNameToCertificate()
 
-	tr := &http.Transport{
-		TLSClientConfig: cfg,
+	if templateFile != "" {
+		clientTemplate, err = LoadClientTemplate(templateFile, clientConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s %s\n", color.Red.Sprint("[X]==>"), err)
+			os.Exit(1)
+		}
 	}
 
-	httpClient := &http.Client{
-		Transport: tr,
+	for _, overlayFile := range overlayFiles {
+		clientTemplate, err = MergeClientOverlay(clientTemplate, overlayFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s %s\n", color.Red.Sprint("[X]==>"), err)
+			os.Exit(1)
+		}
+	}
+
+	// IAM_CACERT trusts the CA of a private instance, IAM_SKIP_VERIFY=true
+	// disables the certificate checks, e.g. for a test instance
+	httpClient, err := tlsHTTPClient("IAM")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s\n", color.Red.Sprint("[X]==>"), err)
+		os.Exit(1)
+	}
+
+	capabilityCheck := os.Getenv("CAPABILITY_CHECK")
+	if capabilityCheck != "" && capabilityCheck != CapabilityWarn &&
+		capabilityCheck != CapabilityDrop && capabilityCheck != CapabilityFail {
+		fmt.Printf("Unknown capability check %q, please use one of: warn, drop, fail\n", capabilityCheck)
+		return
+	}
+
+	store, err := NewClientStore(os.Getenv("CLIENT_STORE"), confDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s\n", color.Red.Sprint("[X]==>"), err)
+		os.Exit(1)
+	}
+
+	cacheDir := os.Getenv("DISCOVERY_CACHE_DIR")
+	if userCacheDir, errCache := os.UserCacheDir(); cacheDir == "" && errCache == nil {
+		cacheDir = filepath.Join(userCacheDir, "dodas-IAMClientRec", "discovery")
 	}
 
 	clientIAM := InitClientConfig{
-		ConfDir:        confDir,
-		ClientConfig:   clientConfig,
-		Scanner:        scanner,
-		HTTPClient:     *httpClient,
-		IAMServer:      iamServer,
-		ClientTemplate: ClientTemplate,
-		NoPWD:          true,
+		ConfDir:                 confDir,
+		ClientConfig:            clientConfig,
+		Scanner:                 scanner,
+		HTTPClient:              *httpClient,
+		IAMServer:               iamServer,
+		ClientTemplate:          clientTemplate,
+		NoPWD:                   true,
+		InitialAccessToken:      initialAccessToken,
+		SoftwareStatement:       softwareStatement,
+		SoftwareStatementKey:    softwareStatementKey,
+		SoftwareStatementIssuer: os.Getenv("SOFTWARE_STATEMENT_ISSUER"),
+		ClientKeyType:           os.Getenv("CLIENT_KEY_TYPE"),
+		CacheDir:                cacheDir,
+		CapabilityCheck:         capabilityCheck,
+		Store:                   store,
+	}
+
+	if operation != "" {
+		var operationArgs []string
+		if len(args) > 1 {
+			operationArgs = args[1:]
+		}
+
+		err = operations[operation](&clientIAM, instance, operationArgs)
+		if err != nil {
+			log.Err(err).Str("operation", operation).Msg("client management")
+			fmt.Fprintf(os.Stderr, "%s %s\n", color.Red.Sprint("[X]==>"), err)
+			os.Exit(exitCode(err))
+		}
+
+		return
 	}
 
 	_, clientResponse, _, err := clientIAM.InitClient(instance)
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "%s %s\n", color.Red.Sprint("[X]==>"), err)
+		os.Exit(exitCode(err))
 	}
 
 	fmt.Println(clientResponse.ClientID)
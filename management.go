@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/awnumar/memguard"
+	"github.com/gookit/color"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	errNoRegistration   = errors.New("no registration access token stored for the client")
+	errSecretNotRotated = errors.New("the server did not issue a new client secret")
+	errProfileChanged   = errors.New("the update would change the client profile")
+)
+
+// secretFields are the client fields never written to the logs.
+var secretFields = []string{
+	"client_secret",
+	"registration_access_token",
+	"refresh_token",
+	"access_token",
+	"private_key",
+}
+
+// redactSecrets returns the JSON document for the logs, with the values of
+// the secretFields replaced.
+func redactSecrets(body []byte) string {
+	var document map[string]interface{}
+
+	if json.Unmarshal(body, &document) != nil {
+		return fmt.Sprintf("%d bytes", len(body))
+	}
+
+	for _, field := range secretFields {
+		if _, ok := document[field]; ok {
+			document[field] = "REDACTED"
+		}
+	}
+
+	redacted, err := json.Marshal(document)
+	if err != nil {
+		return fmt.Sprintf("%d bytes", len(body))
+	}
+
+	return string(redacted)
+}
+
+// manageClient calls the client configuration endpoint (RFC 7592) of a
+// registered client, authenticated with its registration access token.
+func (t *InitClientConfig) manageClient(method string, clientResponse ClientResponse, body []byte) (status int, rbody []byte, err error) {
+	if clientResponse.Endpoint == "" || clientResponse.RegistrationAccessToken == "" {
+		return 0, nil, errNoRegistration
+	}
+
+	log.Debug().Str("method", method).Str("URL", clientResponse.Endpoint).Msg("client management")
+
+	req, err := http.NewRequest(method, clientResponse.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, fmt.Errorf("client management %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+clientResponse.RegistrationAccessToken)
+	req.Header.Set("Accept", "application/json")
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := t.HTTPClient.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %s", errHTTP, err)
+	}
+
+	defer resp.Body.Close()
+
+	log.Debug().Int("StatusCode", resp.StatusCode).Str("Status", resp.Status).Msg("client management")
+
+	var buff bytes.Buffer
+
+	_, err = buff.ReadFrom(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("client management %w", err)
+	}
+
+	log.Debug().Str("body", redactSecrets(buff.Bytes())).Msg("client management")
+
+	return resp.StatusCode, buff.Bytes(), nil
+}
+
+// storeClientConfiguration saves a client configuration returned by the
+// management endpoint, keeping the registration data the server may omit.
+func (t *InitClientConfig) storeClientConfiguration(instance string, old ClientResponse, body []byte, passwd *memguard.Enclave) (clientResponse ClientResponse, err error) {
+	var config map[string]interface{}
+
+	err = json.Unmarshal(body, &config)
+	if err != nil {
+		return clientResponse, fmt.Errorf("store client configuration %w", err)
+	}
+
+	if _, ok := config["registration_client_uri"]; !ok {
+		config["registration_client_uri"] = old.Endpoint
+	}
+
+	if _, ok := config["registration_access_token"]; !ok {
+		config["registration_access_token"] = old.RegistrationAccessToken
+	}
+
+	if _, ok := config["client_secret"]; !ok && old.ClientSecret != "" {
+		config["client_secret"] = old.ClientSecret
+	}
+
+	for key, value := range map[string]string{
+		"issuer":        old.Issuer,
+		"private_key":   old.PrivateKey,
+		"refresh_token": old.RefreshToken,
+	} {
+		if value != "" {
+			config[key] = value
+		}
+	}
+
+	if old.AccessToken != "" {
+		config["access_token"] = old.AccessToken
+		config["access_token_expires_at"] = old.AccessTokenExpiresAt
+	}
+
+	dump, err := json.Marshal(config)
+	if err != nil {
+		return clientResponse, fmt.Errorf("store client configuration %w", err)
+	}
+
+	err = json.Unmarshal(dump, &clientResponse)
+	if err != nil {
+		return clientResponse, fmt.Errorf("store client configuration %w", err)
+	}
+
+	clientResponse.raw = dump
+
+	err = t.SaveClient(instance, dump, passwd)
+	if err != nil {
+		return clientResponse, fmt.Errorf("store client configuration %w", err)
+	}
+
+	return clientResponse, nil
+}
+
+// ShowClient reads the current configuration of the registered client.
+func (t *InitClientConfig) ShowClient(instance string) ([]byte, error) {
+	clientResponse, passwd, err := t.LoadClient(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	status, body, err := t.manageClient(http.MethodGet, clientResponse, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("read client %w", responseError(status, body))
+	}
+
+	// The server may rotate the registration access token on every call
+	_, err = t.storeClientConfiguration(instance, clientResponse, body, passwd)
+	if err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// grantTypes returns the sorted grant types, the default one when empty.
+func grantTypes(values []string) []string {
+	if len(values) == 0 {
+		return []string{GrantAuthorizationCode}
+	}
+
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+
+	return sorted
+}
+
+// checkProfileChange fails when the requested metadata has other grant
+// types or another authentication method than the registered client.
+func checkProfileChange(registered ClientResponse, requested ClientMetadata) error {
+	registeredGrants, requestedGrants := grantTypes(registered.GrantTypes), grantTypes(requested.GrantTypes)
+	if strings.Join(registeredGrants, " ") != strings.Join(requestedGrants, " ") {
+		return fmt.Errorf("%w: grant types %s instead of %s", errProfileChanged,
+			strings.Join(requestedGrants, ", "), strings.Join(registeredGrants, ", "))
+	}
+
+	registeredAuth, requestedAuth := registered.TokenEndpointAuthMethod, requested.TokenEndpointAuthMethod
+	if registeredAuth == "" {
+		registeredAuth = AuthClientSecretBasic
+	}
+
+	if requestedAuth == "" {
+		requestedAuth = AuthClientSecretBasic
+	}
+
+	if registeredAuth != requestedAuth {
+		return fmt.Errorf("%w: authentication method %s instead of %s", errProfileChanged, requestedAuth, registeredAuth)
+	}
+
+	return nil
+}
+
+// UpdateClient replaces the registered client metadata with the one
+// rendered from the current client configuration.
+func (t *InitClientConfig) UpdateClient(instance string) (ClientResponse, error) {
+	clientResponse, passwd, err := t.LoadClient(instance)
+	if err != nil {
+		return clientResponse, err
+	}
+
+	clientKey, err := clientResponse.Key()
+	if err != nil {
+		return clientResponse, fmt.Errorf("update client %w", err)
+	}
+
+	request, err := t.ClientRequest(clientKey, nil)
+	if err != nil {
+		return clientResponse, err
+	}
+
+	var requested ClientMetadata
+
+	err = json.Unmarshal(request, &requested)
+	if err != nil {
+		return clientResponse, fmt.Errorf("update client %w", err)
+	}
+
+	// The update replaces all the metadata, a different profile would turn
+	// the client into another kind of client
+	err = checkProfileChange(clientResponse, requested)
+	if err != nil {
+		return clientResponse, fmt.Errorf("%w, set the CLIENT_PROFILE, CLIENT_TEMPLATE and CLIENT_OVERLAY of the registration", err)
+	}
+
+	var metadata map[string]interface{}
+
+	err = json.Unmarshal(request, &metadata)
+	if err != nil {
+		return clientResponse, fmt.Errorf("update client %w", err)
+	}
+
+	metadata["client_id"] = clientResponse.ClientID
+	if clientResponse.ClientSecret != "" {
+		metadata["client_secret"] = clientResponse.ClientSecret
+	}
+
+	update, err := json.Marshal(metadata)
+	if err != nil {
+		return clientResponse, fmt.Errorf("update client %w", err)
+	}
+
+	status, body, err := t.manageClient(http.MethodPut, clientResponse, update)
+	if err != nil {
+		return clientResponse, err
+	}
+
+	if status != http.StatusOK {
+		return clientResponse, fmt.Errorf("update client %w", responseError(status, body))
+	}
+
+	return t.storeClientConfiguration(instance, clientResponse, body, passwd)
+}
+
+// DeleteClient deregisters the client and removes its stored credentials.
+func (t *InitClientConfig) DeleteClient(instance string) error {
+	clientResponse, _, err := t.LoadClient(instance)
+	if err != nil {
+		return err
+	}
+
+	status, body, err := t.manageClient(http.MethodDelete, clientResponse, nil)
+	if err != nil {
+		return err
+	}
+
+	if status != http.StatusNoContent && status != http.StatusOK {
+		return fmt.Errorf("delete client %w", responseError(status, body))
+	}
+
+	err = t.store().Delete(instance)
+	if err != nil {
+		return fmt.Errorf("delete client %w", err)
+	}
+
+	return nil
+}
+
+// RotateSecret asks the server for a new client secret, sending back the
+// current client configuration without the secret, and stores the result.
+func (t *InitClientConfig) RotateSecret(instance string) (ClientResponse, error) {
+	clientResponse, passwd, err := t.LoadClient(instance)
+	if err != nil {
+		return clientResponse, err
+	}
+
+	status, body, err := t.manageClient(http.MethodGet, clientResponse, nil)
+	if err != nil {
+		return clientResponse, err
+	}
+
+	if status != http.StatusOK {
+		return clientResponse, fmt.Errorf("read client %w", responseError(status, body))
+	}
+
+	// Keep the registration access token the server may have rotated, it is
+	// the only one valid for the update
+	clientResponse, err = t.storeClientConfiguration(instance, clientResponse, body, passwd)
+	if err != nil {
+		return clientResponse, err
+	}
+
+	var metadata map[string]interface{}
+
+	err = json.Unmarshal(body, &metadata)
+	if err != nil {
+		return clientResponse, fmt.Errorf("rotate secret %w", err)
+	}
+
+	for _, field := range []string{
+		"client_secret", "client_secret_expires_at", "client_id_issued_at",
+		"registration_access_token", "registration_client_uri",
+	} {
+		delete(metadata, field)
+	}
+
+	update, err := json.Marshal(metadata)
+	if err != nil {
+		return clientResponse, fmt.Errorf("rotate secret %w", err)
+	}
+
+	status, body, err = t.manageClient(http.MethodPut, clientResponse, update)
+	if err != nil {
+		return clientResponse, err
+	}
+
+	if status != http.StatusOK {
+		return clientResponse, fmt.Errorf("update client %w", responseError(status, body))
+	}
+
+	var rotated ClientResponse
+
+	err = json.Unmarshal(body, &rotated)
+	if err != nil {
+		return clientResponse, fmt.Errorf("rotate secret %w", err)
+	}
+
+	if rotated.ClientSecret == "" || rotated.ClientSecret == clientResponse.ClientSecret {
+		return clientResponse, errSecretNotRotated
+	}
+
+	return t.storeClientConfiguration(instance, clientResponse, body, passwd)
+}
+
+func showOperation(clientIAM *InitClientConfig, instance string, args []string) error {
+	body, err := clientIAM.ShowClient(instance)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+
+	err = json.Indent(&out, body, "", "  ")
+	if err != nil {
+		return fmt.Errorf("show client %w", err)
+	}
+
+	fmt.Println(out.String())
+
+	return nil
+}
+
+func updateOperation(clientIAM *InitClientConfig, instance string, args []string) error {
+	clientResponse, err := clientIAM.UpdateClient(instance)
+	if err != nil {
+		return err
+	}
+
+	color.Green.Printf("==> Client %s updated\n", clientResponse.ClientID)
+
+	return nil
+}
+
+func deleteOperation(clientIAM *InitClientConfig, instance string, args []string) error {
+	err := clientIAM.DeleteClient(instance)
+	if err != nil {
+		return err
+	}
+
+	color.Green.Printf("==> Client %s deleted\n", instance)
+
+	return nil
+}
+
+func rotateOperation(clientIAM *InitClientConfig, instance string, args []string) error {
+	clientResponse, err := clientIAM.RotateSecret(instance)
+	if err != nil {
+		return err
+	}
+
+	color.Green.Printf("==> Client %s secret rotated\n", clientResponse.ClientID)
+
+	fmt.Println(clientResponse.ClientID)
+	fmt.Println(clientResponse.ClientSecret)
+
+	return nil
+}
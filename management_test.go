@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRedactSecrets(t *testing.T) {
+	redacted := redactSecrets([]byte(`{"client_id":"id","client_secret":"s3cr3t","registration_access_token":"r4t"}`))
+
+	if strings.Contains(redacted, "s3cr3t") || strings.Contains(redacted, "r4t") || !strings.Contains(redacted, `"client_id":"id"`) {
+		t.Errorf("redactSecrets = %s", redacted)
+	}
+
+	if redacted := redactSecrets([]byte("not json s3cr3t")); strings.Contains(redacted, "s3cr3t") {
+		t.Errorf("redactSecrets = %s", redacted)
+	}
+}
+
+func TestCheckProfileChange(t *testing.T) {
+	registered := ClientResponse{}
+	registered.GrantTypes = []string{GrantRefreshToken, GrantAuthorizationCode}
+
+	tests := map[string]struct {
+		requested ClientMetadata
+		changed   bool
+	}{
+		"same profile":     {ClientMetadata{GrantTypes: []string{GrantAuthorizationCode, GrantRefreshToken}}, false},
+		"other grants":     {ClientMetadata{GrantTypes: []string{GrantClientCredentials}}, true},
+		"public client":    {ClientMetadata{GrantTypes: registered.GrantTypes, TokenEndpointAuthMethod: AuthNone}, true},
+		"default grants":   {ClientMetadata{}, true},
+		"explicit default": {ClientMetadata{GrantTypes: registered.GrantTypes, TokenEndpointAuthMethod: AuthClientSecretBasic}, false},
+	}
+
+	for name, test := range tests {
+		err := checkProfileChange(registered, test.requested)
+		if changed := errors.Is(err, errProfileChanged); changed != test.changed {
+			t.Errorf("%s: error %v, want changed %v", name, err, test.changed)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidMetadata = errors.New("invalid client metadata")
+)
+
+// Grant types and response types of RFC 7591, section 2.
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantImplicit          = "implicit"
+	GrantPassword          = "password"
+	GrantClientCredentials = "client_credentials"
+	GrantRefreshToken      = "refresh_token"
+	GrantJWTBearer         = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	GrantSAML2Bearer       = "urn:ietf:params:oauth:grant-type:saml2-bearer"
+	GrantDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+	GrantTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+	ResponseCode  = "code"
+	ResponseToken = "token"
+)
+
+// Token endpoint authentication methods of RFC 7591 and OpenID Connect
+// Dynamic Client Registration.
+const (
+	AuthNone              = "none"
+	AuthClientSecretBasic = "client_secret_basic"
+	AuthClientSecretPost  = "client_secret_post"
+	AuthClientSecretJWT   = "client_secret_jwt"
+	AuthPrivateKeyJWT     = "private_key_jwt"
+)
+
+var authMethods = map[string]bool{
+	AuthNone:              true,
+	AuthClientSecretBasic: true,
+	AuthClientSecretPost:  true,
+	AuthClientSecretJWT:   true,
+	AuthPrivateKeyJWT:     true,
+}
+
+// ClientMetadata is the client metadata sent in a dynamic client
+// registration request (RFC 7591, section 2).
+type ClientMetadata struct {
+	RedirectURIs            []string        `json:"redirect_uris,omitempty"`
+	TokenEndpointAuthMethod string          `json:"token_endpoint_auth_method,omitempty"`
+	GrantTypes              []string        `json:"grant_types,omitempty"`
+	ResponseTypes           []string        `json:"response_types,omitempty"`
+	ClientName              string          `json:"client_name,omitempty"`
+	ClientURI               string          `json:"client_uri,omitempty"`
+	LogoURI                 string          `json:"logo_uri,omitempty"`
+	Scope                   string          `json:"scope,omitempty"`
+	Contacts                []string        `json:"contacts,omitempty"`
+	TosURI                  string          `json:"tos_uri,omitempty"`
+	PolicyURI               string          `json:"policy_uri,omitempty"`
+	JwksURI                 string          `json:"jwks_uri,omitempty"`
+	Jwks                    json.RawMessage `json:"jwks,omitempty"`
+	SoftwareID              string          `json:"software_id,omitempty"`
+	SoftwareVersion         string          `json:"software_version,omitempty"`
+	SoftwareStatement       string          `json:"software_statement,omitempty"`
+}
+
+func contains(values []string, value string) bool {
+	for _, cur := range values {
+		if cur == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validateURI(field string, value string) error {
+	if value == "" {
+		return nil
+	}
+
+	uri, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%w: %s %s", errInvalidMetadata, field, err)
+	}
+
+	if !uri.IsAbs() || uri.Host == "" {
+		return fmt.Errorf("%w: %s must be an absolute URL: %q", errInvalidMetadata, field, value)
+	}
+
+	return nil
+}
+
+// NeedsRedirect tells whether the client uses redirect based grant types
+// but has no redirect uris yet.
+func (m *ClientMetadata) NeedsRedirect() bool {
+	if len(m.RedirectURIs) > 0 {
+		return false
+	}
+
+	return len(m.GrantTypes) == 0 || contains(m.GrantTypes, GrantAuthorizationCode) ||
+		contains(m.GrantTypes, GrantImplicit)
+}
+
+// Validate checks the metadata values and their consistency as described in
+// RFC 7591, section 2.1.
+func (m *ClientMetadata) Validate() error {
+	grantTypes := m.GrantTypes
+	if len(grantTypes) == 0 {
+		grantTypes = []string{GrantAuthorizationCode}
+	}
+
+	responseTypes := m.ResponseTypes
+	if len(responseTypes) == 0 {
+		responseTypes = []string{ResponseCode}
+	}
+
+	for _, pair := range [][2]string{
+		{GrantAuthorizationCode, ResponseCode},
+		{GrantImplicit, ResponseToken},
+	} {
+		if contains(grantTypes, pair[0]) && !contains(responseTypes, pair[1]) {
+			return fmt.Errorf("%w: grant type %q requires response type %q", errInvalidMetadata, pair[0], pair[1])
+		}
+
+		if contains(m.ResponseTypes, pair[1]) && !contains(grantTypes, pair[0]) {
+			return fmt.Errorf("%w: response type %q requires grant type %q", errInvalidMetadata, pair[1], pair[0])
+		}
+	}
+
+	if (contains(grantTypes, GrantAuthorizationCode) || contains(grantTypes, GrantImplicit)) &&
+		len(m.RedirectURIs) == 0 {
+		return fmt.Errorf("%w: redirect_uris are required by the redirect based grant types", errInvalidRedirectURI)
+	}
+
+	for _, redirect := range m.RedirectURIs {
+		// Native applications may use private-use URI schemes without host
+		uri, err := url.Parse(redirect)
+		if err != nil || !uri.IsAbs() {
+			return fmt.Errorf("%w: redirect_uris must be absolute URIs: %q", errInvalidRedirectURI, redirect)
+		}
+
+		if uri.Fragment != "" {
+			return fmt.Errorf("%w: redirect_uris must not contain a fragment: %q", errInvalidRedirectURI, redirect)
+		}
+	}
+
+	if m.TokenEndpointAuthMethod != "" && !authMethods[m.TokenEndpointAuthMethod] {
+		return fmt.Errorf("%w: unknown token_endpoint_auth_method %q", errInvalidMetadata, m.TokenEndpointAuthMethod)
+	}
+
+	for field, value := range map[string]string{
+		"client_uri": m.ClientURI,
+		"logo_uri":   m.LogoURI,
+		"tos_uri":    m.TosURI,
+		"policy_uri": m.PolicyURI,
+		"jwks_uri":   m.JwksURI,
+	} {
+		if err := validateURI(field, value); err != nil {
+			return err
+		}
+	}
+
+	if m.JwksURI != "" && len(m.Jwks) != 0 {
+		return fmt.Errorf("%w: jwks_uri and jwks must not both be present", errInvalidMetadata)
+	}
+
+	if len(m.Jwks) != 0 {
+		var jwks struct {
+			Keys []json.RawMessage `json:"keys"`
+		}
+
+		if err := json.Unmarshal(m.Jwks, &jwks); err != nil || len(jwks.Keys) == 0 {
+			return fmt.Errorf("%w: jwks must be a JWK Set with at least one key", errInvalidMetadata)
+		}
+	}
+
+	if m.TokenEndpointAuthMethod == AuthPrivateKeyJWT && m.JwksURI == "" && len(m.Jwks) == 0 {
+		return fmt.Errorf("%w: %s requires jwks or jwks_uri", errInvalidMetadata, AuthPrivateKeyJWT)
+	}
+
+	if m.TokenEndpointAuthMethod == AuthNone && contains(grantTypes, GrantClientCredentials) {
+		return fmt.Errorf("%w: public clients cannot use the %s grant", errInvalidMetadata, GrantClientCredentials)
+	}
+
+	if m.SoftwareStatement != "" && strings.Count(m.SoftwareStatement, ".") != 2 {
+		return fmt.Errorf("%w: software_statement is not a JWT", errInvalidSoftwareStatement)
+	}
+
+	return nil
+}
+
+// SignSoftwareStatement returns a software statement (RFC 7591, section 2.3)
+// asserting the metadata values, signed with the key on behalf of the issuer.
+func (m ClientMetadata) SignSoftwareStatement(key crypto.Signer, issuer string) (string, error) {
+	m.SoftwareStatement = ""
+
+	content, err := json.Marshal(m)
+	if err != nil {
+		return "", fmt.Errorf("software statement %w", err)
+	}
+
+	var claims map[string]interface{}
+
+	err = json.Unmarshal(content, &claims)
+	if err != nil {
+		return "", fmt.Errorf("software statement %w", err)
+	}
+
+	if issuer != "" {
+		claims["iss"] = issuer
+	}
+
+	claims["iat"] = time.Now().Unix()
+
+	return SignJWT(key, "", claims)
+}
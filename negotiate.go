@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gookit/color"
+	"github.com/rs/zerolog/log"
+)
+
+// Capability check modes, for the client metadata values the provider does
+// not advertise.
+const (
+	CapabilityWarn = "warn"
+	CapabilityDrop = "drop"
+	CapabilityFail = "fail"
+)
+
+var (
+	errUnsupportedCapability = errors.New("requested values not supported by the provider")
+	errCapabilityDowngraded  = errors.New("the provider registered the client with less than requested")
+)
+
+// scopeSupported matches also parametric scopes, as the WLCG storage.read:/path,
+// by their name.
+func scopeSupported(supported []string, scope string) bool {
+	if contains(supported, scope) {
+		return true
+	}
+
+	name := strings.SplitN(scope, ":", 2)[0]
+	if name == scope {
+		return false
+	}
+
+	for _, cur := range supported {
+		if strings.SplitN(cur, ":", 2)[0] == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unsupported splits the requested values in the supported and unsupported
+// ones. Everything is supported when the provider does not advertise a list.
+func unsupported(supported []string, requested []string, match func([]string, string) bool) (keep []string, drop []string) {
+	if len(supported) == 0 {
+		return requested, nil
+	}
+
+	for _, value := range requested {
+		if match(supported, value) {
+			keep = append(keep, value)
+		} else {
+			drop = append(drop, value)
+		}
+	}
+
+	return keep, drop
+}
+
+// NegotiateCapabilities compares the client metadata with the scopes, grant
+// types, response types and authentication methods supported by the
+// provider. Unsupported values are reported, removed or rejected depending
+// on the mode.
+func NegotiateCapabilities(metadata ClientMetadata, provider *ProviderMetadata, mode string) (ClientMetadata, error) {
+	var problems []string
+
+	scopes, dropScopes := unsupported(provider.ScopesSupported, strings.Fields(metadata.Scope), scopeSupported)
+	if len(dropScopes) > 0 {
+		problems = append(problems, fmt.Sprintf("scope %s", strings.Join(dropScopes, " ")))
+	}
+
+	grantTypes, dropGrants := unsupported(provider.GrantTypesSupported, metadata.GrantTypes, contains)
+	if len(dropGrants) > 0 {
+		problems = append(problems, fmt.Sprintf("grant_types %s", strings.Join(dropGrants, " ")))
+	}
+
+	responseTypes, dropResponses := unsupported(provider.ResponseTypesSupported, metadata.ResponseTypes, contains)
+	if len(dropResponses) > 0 {
+		problems = append(problems, fmt.Sprintf("response_types %s", strings.Join(dropResponses, " ")))
+	}
+
+	// There is no fallback for the authentication method, it is kept and
+	// reported even when dropping
+	var authProblem string
+
+	authMethod := metadata.TokenEndpointAuthMethod
+	if authMethod != "" && len(provider.TokenEndpointAuthMethodsSupported) > 0 &&
+		!contains(provider.TokenEndpointAuthMethodsSupported, authMethod) {
+		authProblem = fmt.Sprintf("token_endpoint_auth_method %s", authMethod)
+	}
+
+	all := problems
+	if authProblem != "" {
+		all = append(all, authProblem)
+	}
+
+	if len(all) == 0 {
+		return metadata, nil
+	}
+
+	err := fmt.Errorf("%w: %s", errUnsupportedCapability, strings.Join(all, ", "))
+
+	switch mode {
+	case CapabilityFail:
+		return metadata, err
+	case CapabilityDrop:
+		if len(problems) > 0 {
+			err = fmt.Errorf("%w: %s", errUnsupportedCapability, strings.Join(problems, ", "))
+			log.Warn().Err(err).Msg("capabilities - dropping unsupported values")
+			color.Yellow.Printf("==> Dropping %s\n", err)
+		}
+
+		if authProblem != "" {
+			err = fmt.Errorf("%w: %s", errUnsupportedCapability, authProblem)
+			log.Warn().Err(err).Msg("capabilities - cannot drop the authentication method")
+			color.Yellow.Printf("==> Warning: %s, cannot be dropped\n", err)
+		}
+
+		metadata.Scope = strings.Join(scopes, " ")
+		metadata.GrantTypes = grantTypes
+		metadata.ResponseTypes = responseTypes
+	default:
+		log.Warn().Err(err).Msg("capabilities")
+		color.Yellow.Printf("==> Warning: %s\n", err)
+	}
+
+	return metadata, nil
+}
+
+// checkDowngrade compares the registered client with the requested metadata,
+// since providers may silently drop the values they do not grant.
+func checkDowngrade(requested []byte, registered []byte) error {
+	var request, response ClientMetadata
+
+	err := json.Unmarshal(requested, &request)
+	if err != nil {
+		return fmt.Errorf("check registration %w", err)
+	}
+
+	err = json.Unmarshal(registered, &response)
+	if err != nil {
+		return fmt.Errorf("check registration %w", err)
+	}
+
+	var problems []string
+
+	for _, scope := range strings.Fields(request.Scope) {
+		if response.Scope != "" && !contains(strings.Fields(response.Scope), scope) {
+			problems = append(problems, fmt.Sprintf("scope %s", scope))
+		}
+	}
+
+	for _, grantType := range request.GrantTypes {
+		if len(response.GrantTypes) > 0 && !contains(response.GrantTypes, grantType) {
+			problems = append(problems, fmt.Sprintf("grant_type %s", grantType))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: missing %s", errCapabilityDowngraded, strings.Join(problems, ", "))
+	}
+
+	return nil
+}
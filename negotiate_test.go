@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateCapabilities(t *testing.T) {
+	provider := &ProviderMetadata{
+		ScopesSupported:                   []string{"openid", "offline_access", "storage.read:/"},
+		GrantTypesSupported:               []string{GrantAuthorizationCode, GrantRefreshToken},
+		ResponseTypesSupported:            []string{ResponseCode},
+		TokenEndpointAuthMethodsSupported: []string{AuthClientSecretBasic},
+	}
+
+	supported := ClientMetadata{
+		Scope:         "openid storage.read:/data",
+		GrantTypes:    []string{GrantAuthorizationCode, GrantRefreshToken},
+		ResponseTypes: []string{ResponseCode},
+	}
+
+	unsupported := ClientMetadata{
+		Scope:         "openid compute.create",
+		GrantTypes:    []string{GrantAuthorizationCode, GrantClientCredentials},
+		ResponseTypes: []string{ResponseCode},
+	}
+
+	dropped := ClientMetadata{
+		Scope:         "openid",
+		GrantTypes:    []string{GrantAuthorizationCode},
+		ResponseTypes: []string{ResponseCode},
+	}
+
+	privateKeyJWT := supported
+	privateKeyJWT.TokenEndpointAuthMethod = AuthPrivateKeyJWT
+
+	tests := map[string]struct {
+		metadata ClientMetadata
+		mode     string
+		want     ClientMetadata
+		err      error
+	}{
+		"supported":                {supported, CapabilityFail, supported, nil},
+		"warn":                     {unsupported, CapabilityWarn, unsupported, nil},
+		"default mode":             {unsupported, "", unsupported, nil},
+		"drop":                     {unsupported, CapabilityDrop, dropped, nil},
+		"fail":                     {unsupported, CapabilityFail, unsupported, errUnsupportedCapability},
+		"auth method warn":         {privateKeyJWT, CapabilityWarn, privateKeyJWT, nil},
+		"auth method kept by drop": {privateKeyJWT, CapabilityDrop, privateKeyJWT, nil},
+		"auth method fail":         {privateKeyJWT, CapabilityFail, privateKeyJWT, errUnsupportedCapability},
+	}
+
+	for name, test := range tests {
+		metadata, err := NegotiateCapabilities(test.metadata, provider, test.mode)
+
+		switch {
+		case test.err == nil && err != nil:
+			t.Errorf("%s: NegotiateCapabilities error %v", name, err)
+		case test.err != nil && !errors.Is(err, test.err):
+			t.Errorf("%s: NegotiateCapabilities error %v, want %v", name, err, test.err)
+		case !reflect.DeepEqual(metadata, test.want):
+			t.Errorf("%s: NegotiateCapabilities = %+v, want %+v", name, metadata, test.want)
+		}
+	}
+}
+
+func TestNegotiateCapabilitiesNotAdvertised(t *testing.T) {
+	metadata := ClientMetadata{
+		Scope:                   "openid compute.create",
+		GrantTypes:              []string{GrantDeviceCode},
+		TokenEndpointAuthMethod: AuthPrivateKeyJWT,
+	}
+
+	negotiated, err := NegotiateCapabilities(metadata, &ProviderMetadata{}, CapabilityFail)
+	if err != nil || !reflect.DeepEqual(negotiated, metadata) {
+		t.Errorf("NegotiateCapabilities = %+v, %v", negotiated, err)
+	}
+}
+
+func TestCheckDowngrade(t *testing.T) {
+	requested := `{"scope":"openid offline_access","grant_types":["authorization_code","refresh_token"]}`
+
+	tests := map[string]struct {
+		registered string
+		err        error
+	}{
+		"granted":            {`{"scope":"offline_access openid","grant_types":["refresh_token","authorization_code"]}`, nil},
+		"not echoed":         {`{"client_id":"id"}`, nil},
+		"scope dropped":      {`{"scope":"openid","grant_types":["authorization_code","refresh_token"]}`, errCapabilityDowngraded},
+		"grant type dropped": {`{"scope":"openid offline_access","grant_types":["authorization_code"]}`, errCapabilityDowngraded},
+	}
+
+	for name, test := range tests {
+		err := checkDowngrade([]byte(requested), []byte(test.registered))
+
+		switch {
+		case test.err == nil && err != nil:
+			t.Errorf("%s: checkDowngrade error %v", name, err)
+		case test.err != nil && !errors.Is(err, test.err):
+			t.Errorf("%s: checkDowngrade error %v, want %v", name, err, test.err)
+		}
+	}
+
+	if err := checkDowngrade([]byte(requested), []byte(`{"scope":`)); err == nil {
+		t.Error("checkDowngrade accepted an invalid registration response")
+	}
+}
+
+func TestScopeSupported(t *testing.T) {
+	supported := []string{"openid", "storage.read:/", "compute.create"}
+
+	for scope, want := range map[string]bool{
+		"openid":              true,
+		"storage.read:/data":  true,
+		"storage.write:/data": false,
+		"compute.create":      true,
+		"compute":             false,
+	} {
+		if got := scopeSupported(supported, scope); got != want {
+			t.Errorf("scopeSupported(%q) = %v, want %v", scope, got, want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	errClientNotStored = errors.New("no client stored for the instance")
+	errUnknownStore    = errors.New("unknown client store")
+	errClientEncrypted = errors.New("the client is encrypted, please set env CLIENT_STORE=encrypted-file")
+	errStoreConflict   = errors.New("the client was modified by another run since it was loaded")
+)
+
+// ClientStore keeps the registered clients, by instance name.
+type ClientStore interface {
+	// Load returns the stored client, errClientNotStored when there is none
+	Load(instance string) ([]byte, error)
+	Save(instance string, body []byte) error
+	Delete(instance string) error
+	Exists(instance string) (bool, error)
+	// Encrypted tells whether the clients are encrypted with a password
+	// before being saved
+	Encrypted() bool
+	// Location describes where the client of the instance is stored
+	Location(instance string) string
+}
+
+// clientLocker is implemented by the stores shared by the processes of a
+// node, to serialize the load, refresh and save of the tokens of a client.
+type clientLocker interface {
+	// Lock blocks until the client is locked and returns the unlock function
+	Lock(instance string) (unlock func(), err error)
+}
+
+// FileStore keeps the clients as plaintext files, readable by the user
+// only, in a directory.
+type FileStore struct {
+	Dir string
+}
+
+func (s FileStore) filename(instance string) string {
+	return filepath.Join(s.Dir, instance+".json")
+}
+
+// Load reads the client file.
+func (s FileStore) Load(instance string) ([]byte, error) {
+	body, err := ioutil.ReadFile(s.filename(instance))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", errClientNotStored, s.filename(instance))
+	}
+
+	return body, err
+}
+
+// Save replaces the client file atomically.
+func (s FileStore) Save(instance string, body []byte) error {
+	return writeFileAtomic(s.filename(instance), body, 0600)
+}
+
+// Delete removes the client file.
+func (s FileStore) Delete(instance string) error {
+	err := os.Remove(s.filename(instance))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", errClientNotStored, s.filename(instance))
+	}
+
+	return err
+}
+
+// Exists tells whether the client file is there.
+func (s FileStore) Exists(instance string) (bool, error) {
+	_, err := os.Stat(s.filename(instance))
+
+	switch {
+	case os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return true, nil
+	}
+}
+
+// Lock takes an exclusive lock on the <instance>.lock file, next to the
+// client file. Nothing is locked while the directory does not exist.
+func (s FileStore) Lock(instance string) (func(), error) {
+	lockFile, err := os.OpenFile(filepath.Join(s.Dir, instance+".lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if os.IsNotExist(err) {
+		return func() {}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("lock client %w", err)
+	}
+
+	log.Debug().Str("filename", lockFile.Name()).Msg("credentials - lock client")
+
+	err = lockFileExclusive(lockFile)
+	if err != nil {
+		lockFile.Close()
+
+		return nil, fmt.Errorf("lock client %w", err)
+	}
+
+	return func() {
+		unlockFile(lockFile) // nolint: errcheck
+		lockFile.Close()
+	}, nil
+}
+
+// Encrypted is false, the files are stored as they are.
+func (s FileStore) Encrypted() bool {
+	return false
+}
+
+// Location is the client file name.
+func (s FileStore) Location(instance string) string {
+	return s.filename(instance)
+}
+
+// plaintextStore tells whether the store keeps the clients unencrypted on
+// the local disk.
+func plaintextStore(store ClientStore) bool {
+	_, ok := store.(FileStore)
+
+	return ok
+}
+
+// EncryptedFileStore keeps the clients as files encrypted with a password
+// (see Encrypt).
+type EncryptedFileStore struct {
+	FileStore
+}
+
+// Encrypted is true.
+func (s EncryptedFileStore) Encrypted() bool {
+	return true
+}
+
+// storeRequest sends a request to the API of a store and returns the status
+// code and the body of the response.
+func storeRequest(client *http.Client, req *http.Request) (status int, body []byte, err error) {
+	log.Debug().Str("method", req.Method).Str("URL", req.URL.String()).Msg("store")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %s", errHTTP, err)
+	}
+
+	defer resp.Body.Close()
+
+	var buff bytes.Buffer
+
+	_, err = buff.ReadFrom(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("%w: %s", errHTTP, err)
+	}
+
+	log.Debug().Int("StatusCode", resp.StatusCode).Str("Status", resp.Status).Msg("store")
+
+	return resp.StatusCode, buff.Bytes(), nil
+}
+
+// NewClientStore returns the store of the given kind, "file" (the default),
+// "encrypted-file", "keyring", "vault" or "kubernetes", configured from the
+// environment.
+func NewClientStore(kind string, confDir string) (ClientStore, error) {
+	switch kind {
+	case "", "file":
+		return FileStore{Dir: confDir}, nil
+	case "encrypted-file":
+		return EncryptedFileStore{FileStore{Dir: confDir}}, nil
+	case "keyring":
+		return NewKeyringStore()
+	case "vault":
+		return NewVaultStore()
+	case "kubernetes":
+		return NewKubernetesStore()
+	default:
+		return nil, fmt.Errorf("%w %q, please use one of: file, encrypted-file, keyring, vault, kubernetes", errUnknownStore, kind)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iamclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	testClientStore(t, FileStore{Dir: dir})
+}
+
+// fakeVault serves the KV version 2 API of the secret mount.
+type fakeVault struct {
+	sync.Mutex
+	secrets  map[string]json.RawMessage
+	versions map[string]int
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if r.Header.Get("X-Vault-Token") != "root" {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/secret/")
+
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "data/"):
+		data, ok := f.secrets[strings.TrimPrefix(path, "data/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors":[]}`))
+
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"data":     data,
+				"metadata": map[string]int{"version": f.versions[strings.TrimPrefix(path, "data/")]},
+			},
+		})
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "data/"):
+		var request struct {
+			Data    json.RawMessage `json:"data"`
+			Options struct {
+				CAS *int `json:"cas"`
+			} `json:"options"`
+		}
+
+		if json.NewDecoder(r.Body).Decode(&request) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		name := strings.TrimPrefix(path, "data/")
+
+		if request.Options.CAS != nil && *request.Options.CAS != f.versions[name] {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errors":["check-and-set parameter did not match the current version"]}`))
+
+			return
+		}
+
+		f.versions[name]++
+		f.secrets[name] = request.Data
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]int{"version": f.versions[name]},
+		})
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "metadata/"):
+		delete(f.secrets, strings.TrimPrefix(path, "metadata/"))
+		delete(f.versions, strings.TrimPrefix(path, "metadata/"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestVaultStore(t *testing.T) {
+	vault := &fakeVault{secrets: map[string]json.RawMessage{}, versions: map[string]int{}}
+
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	store := &VaultStore{
+		Address:    server.URL,
+		Token:      "root",
+		Mount:      "secret",
+		Path:       "dodas-IAMClientRec",
+		HTTPClient: server.Client(),
+	}
+
+	testClientStore(t, store)
+
+	if len(vault.secrets) != 0 {
+		t.Errorf("secrets left after delete: %v", vault.secrets)
+	}
+
+	store.Token = "wrong"
+
+	_, err := store.Load("instance")
+	if !errors.Is(err, errHTTP) || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Load with a wrong token: error %v", err)
+	}
+}
+
+// fakeKubernetes serves the Secrets API of the default namespace.
+type fakeKubernetes struct {
+	sync.Mutex
+	secrets map[string][]byte
+	puts    int
+	version int
+}
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	const prefix = "/api/v1/namespaces/default/secrets"
+
+	if r.Header.Get("Authorization") != "Bearer kubetoken" || !strings.HasPrefix(r.URL.Path, prefix) {
+		w.WriteHeader(http.StatusForbidden)
+
+		return
+	}
+
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch r.Method {
+	case http.MethodGet, http.MethodDelete:
+		secret, ok := f.secrets[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"kind":"Status","message":"secrets \"` + name + `\" not found"}`))
+
+			return
+		}
+
+		if r.Method == http.MethodDelete {
+			delete(f.secrets, name)
+		}
+
+		_, _ = w.Write(secret)
+	case http.MethodPost, http.MethodPut:
+		var secret kubernetesSecret
+
+		if json.Unmarshal(body, &secret) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		stored, exists := f.secrets[secret.Metadata.Name]
+
+		var current kubernetesSecret
+
+		_ = json.Unmarshal(stored, &current)
+
+		switch {
+		case r.Method == http.MethodPost && exists:
+			w.WriteHeader(http.StatusConflict)
+
+			return
+		case r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+		case name != secret.Metadata.Name || !exists:
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		case secret.Metadata.ResourceVersion != "" && secret.Metadata.ResourceVersion != current.Metadata.ResourceVersion:
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"kind":"Status","message":"the object has been modified"}`))
+
+			return
+		default:
+			f.puts++
+		}
+
+		f.version++
+		secret.Metadata.ResourceVersion = strconv.Itoa(f.version)
+		body, _ = json.Marshal(secret)
+
+		f.secrets[secret.Metadata.Name] = body
+		_, _ = w.Write(body)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestKubernetesStore(t *testing.T) {
+	kubernetes := &fakeKubernetes{secrets: map[string][]byte{}}
+
+	server := httptest.NewServer(kubernetes)
+	defer server.Close()
+
+	store := &KubernetesStore{
+		APIServer:  server.URL,
+		Token:      "kubetoken",
+		Namespace:  "default",
+		Prefix:     "iam-client-",
+		HTTPClient: server.Client(),
+	}
+
+	testClientStore(t, store)
+
+	if kubernetes.puts != 1 {
+		t.Errorf("the existing Secret was replaced %d times, want 1", kubernetes.puts)
+	}
+
+	err := store.Delete("instance")
+	if !errors.Is(err, errClientNotStored) {
+		t.Errorf("Delete of a missing client: error %v, want %v", err, errClientNotStored)
+	}
+}
+
+func TestVaultStoreConflict(t *testing.T) {
+	server := httptest.NewServer(&fakeVault{secrets: map[string]json.RawMessage{}, versions: map[string]int{}})
+	defer server.Close()
+
+	newStore := func() ClientStore {
+		return &VaultStore{
+			Address:    server.URL,
+			Token:      "root",
+			Mount:      "secret",
+			Path:       "dodas-IAMClientRec",
+			HTTPClient: server.Client(),
+		}
+	}
+
+	testStoreConflict(t, newStore(), newStore())
+}
+
+func TestKubernetesStoreConflict(t *testing.T) {
+	server := httptest.NewServer(&fakeKubernetes{secrets: map[string][]byte{}})
+	defer server.Close()
+
+	newStore := func() ClientStore {
+		return &KubernetesStore{
+			APIServer:  server.URL,
+			Token:      "kubetoken",
+			Namespace:  "default",
+			Prefix:     "iam-client-",
+			HTTPClient: server.Client(),
+		}
+	}
+
+	testStoreConflict(t, newStore(), newStore())
+}
+
+// testStoreConflict refreshes the client from two runs, the second one must
+// not overwrite the tokens saved by the first one.
+func testStoreConflict(t *testing.T, first ClientStore, second ClientStore) {
+	t.Helper()
+
+	err := first.Save("instance", []byte(`{"client_id":"id","refresh_token":"rt1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, store := range []ClientStore{first, second} {
+		if _, err := store.Load("instance"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = first.Save("instance", []byte(`{"client_id":"id","refresh_token":"rt2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = second.Save("instance", []byte(`{"client_id":"id","refresh_token":"rt3"}`))
+	if !errors.Is(err, errStoreConflict) {
+		t.Fatalf("Save of a modified client: error %v, want %v", err, errStoreConflict)
+	}
+
+	body, err := second.Load("instance")
+	if err != nil || !strings.Contains(string(body), "rt2") {
+		t.Fatalf("Load = %s, %v", body, err)
+	}
+
+	err = second.Save("instance", []byte(`{"client_id":"id","refresh_token":"rt3"}`))
+	if err != nil {
+		t.Errorf("Save after Load: %v", err)
+	}
+}
+
+func TestKubernetesStoreSecretKeys(t *testing.T) {
+	kubernetes := &fakeKubernetes{secrets: map[string][]byte{}}
+
+	server := httptest.NewServer(kubernetes)
+	defer server.Close()
+
+	store := &KubernetesStore{
+		APIServer:  server.URL,
+		Token:      "kubetoken",
+		Namespace:  "default",
+		Prefix:     "iam-client-",
+		HTTPClient: server.Client(),
+	}
+
+	err := store.Save("Instance", []byte(`{"client_id":"id","client_secret":"secret"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var secret kubernetesSecret
+
+	err = json.Unmarshal(kubernetes.secrets["iam-client-instance"], &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(secret.Data["client_id"]) != "id" || string(secret.Data["client_secret"]) != "secret" {
+		t.Errorf("Secret data %q", secret.Data)
+	}
+}
+
+// testClientStore saves, replaces, loads and deletes a client.
+func testClientStore(t *testing.T, store ClientStore) {
+	t.Helper()
+
+	_, err := store.Load("instance")
+	if !errors.Is(err, errClientNotStored) {
+		t.Fatalf("Load of a missing client: error %v, want %v", err, errClientNotStored)
+	}
+
+	exists, err := store.Exists("instance")
+	if err != nil || exists {
+		t.Fatalf("Exists of a missing client = %v, %v", exists, err)
+	}
+
+	for _, body := range []string{`{"client_id":"id"}`, `{"client_id":"id","refresh_token":"rt"}`} {
+		err = store.Save("instance", []byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body, err := store.Load("instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clientResponse ClientResponse
+
+	err = json.Unmarshal(body, &clientResponse)
+	if err != nil || clientResponse.RefreshToken != "rt" {
+		t.Errorf("Load = %s, %v", body, err)
+	}
+
+	exists, err = store.Exists("instance")
+	if err != nil || !exists {
+		t.Errorf("Exists = %v, %v", exists, err)
+	}
+
+	err = store.Delete("instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.Load("instance")
+	if !errors.Is(err, errClientNotStored) {
+		t.Errorf("Load after delete: error %v, want %v", err, errClientNotStored)
+	}
+}
@@ -1,21 +1,249 @@
 package main
 
-// ClientTemplate ..
-const ClientTemplate = `{
-	"redirect_uris": [
-	  "{{ .CallbackURL }}"
-	],
-	"client_name": "{{ .ClientName }}",
-	"contacts": [
-	  "client@iam.test"
-	],
-	"token_endpoint_auth_method": "client_secret_basic",
-	"scope": "address phone openid email profile offline_access wlcg wlcg.groups",
-	"grant_types": [
-	  "refresh_token",
-	  "authorization_code"
-	],
-	"response_types": [
-	  "code"
-	]
-  }`
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+// ClientTemplate is the metadata of the registered clients, completed with
+// the callback URL and the client name of the IAMClientConfig. Services can
+// also exchange the tokens of their users (RFC 8693) with it.
+var ClientTemplate = ClientMetadata{
+	Contacts: []string{
+		"client@iam.test",
+	},
+	TokenEndpointAuthMethod: AuthClientSecretBasic,
+	Scope:                   "address phone openid email profile offline_access wlcg wlcg.groups",
+	GrantTypes: []string{
+		GrantRefreshToken,
+		GrantAuthorizationCode,
+		GrantTokenExchange,
+	},
+	ResponseTypes: []string{
+		ResponseCode,
+	},
+}
+
+// PublicClientTemplate is the metadata of public clients, for command line
+// tools and notebooks that cannot keep a secret: they authenticate with
+// PKCE only and receive the authorization code on a loopback redirect
+// (RFC 8252, section 7.3).
+var PublicClientTemplate = ClientMetadata{
+	RedirectURIs: []string{
+		"http://127.0.0.1:8976/callback",
+		"http://localhost:8976/callback",
+	},
+	Contacts: []string{
+		"client@iam.test",
+	},
+	TokenEndpointAuthMethod: AuthNone,
+	Scope:                   "openid email profile offline_access wlcg wlcg.groups",
+	GrantTypes: []string{
+		GrantRefreshToken,
+		GrantAuthorizationCode,
+	},
+	ResponseTypes: []string{
+		ResponseCode,
+	},
+}
+
+// DeviceClientTemplate is the metadata of clients for nodes and containers
+// without a browser, logging in with the device authorization grant
+// (RFC 8628).
+var DeviceClientTemplate = ClientMetadata{
+	Contacts: []string{
+		"client@iam.test",
+	},
+	TokenEndpointAuthMethod: AuthClientSecretBasic,
+	Scope:                   "openid email profile offline_access wlcg wlcg.groups",
+	GrantTypes: []string{
+		GrantRefreshToken,
+		GrantDeviceCode,
+	},
+}
+
+// ServiceClientTemplate is the metadata of the clients of robots and
+// service accounts, without a user, that obtain their tokens with the client
+// credentials grant.
+var ServiceClientTemplate = ClientMetadata{
+	Contacts: []string{
+		"client@iam.test",
+	},
+	TokenEndpointAuthMethod: AuthClientSecretBasic,
+	Scope:                   "wlcg wlcg.groups",
+	GrantTypes: []string{
+		GrantClientCredentials,
+	},
+}
+
+// ClientProfiles are the built-in client templates, selected by name.
+var ClientProfiles = map[string]ClientMetadata{
+	"confidential": ClientTemplate,
+	"public":       PublicClientTemplate,
+	"device":       DeviceClientTemplate,
+	"service":      ServiceClientTemplate,
+}
+
+// LoadClientTemplate renders a user supplied client template, in JSON or
+// YAML, with the client configuration and uses it in place of the built-in
+// ClientTemplate. Values can be escaped with the json template function.
+func LoadClientTemplate(filename string, config IAMClientConfig) (metadata ClientMetadata, err error) {
+	log.Debug().Str("filename", filename).Msg("client template")
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return metadata, fmt.Errorf("client template %w", err)
+	}
+
+	tmpl, err := template.New(filepath.Base(filename)).Funcs(template.FuncMap{
+		"json": func(value interface{}) (string, error) {
+			out, err := json.Marshal(value)
+
+			return string(out), err
+		},
+	}).Parse(string(content))
+	if err != nil {
+		return metadata, fmt.Errorf("client template %w", err)
+	}
+
+	var b bytes.Buffer
+
+	err = tmpl.Execute(&b, config)
+	if err != nil {
+		return metadata, fmt.Errorf("client template %w", err)
+	}
+
+	document, err := decodeDocument(filename, b.Bytes())
+	if err != nil {
+		return metadata, fmt.Errorf("client template %w", err)
+	}
+
+	return metadataFromDocument(document)
+}
+
+// MergeClientOverlay merges a JSON or YAML overlay file on top of the client
+// metadata, with the JSON merge patch rules (RFC 7396): objects are merged,
+// any other value replaces the current one and null removes it.
+func MergeClientOverlay(metadata ClientMetadata, filename string) (ClientMetadata, error) {
+	log.Debug().Str("filename", filename).Msg("client overlay")
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return metadata, fmt.Errorf("client overlay %w", err)
+	}
+
+	overlay, err := decodeDocument(filename, content)
+	if err != nil {
+		return metadata, fmt.Errorf("client overlay %w", err)
+	}
+
+	current, err := json.Marshal(metadata)
+	if err != nil {
+		return metadata, fmt.Errorf("client overlay %w", err)
+	}
+
+	var document map[string]interface{}
+
+	err = json.Unmarshal(current, &document)
+	if err != nil {
+		return metadata, fmt.Errorf("client overlay %w", err)
+	}
+
+	return metadataFromDocument(mergePatch(document, overlay))
+}
+
+func mergePatch(target map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	for key, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			delete(target, key)
+		case map[string]interface{}:
+			cur, ok := target[key].(map[string]interface{})
+			if !ok {
+				cur = map[string]interface{}{}
+			}
+
+			target[key] = mergePatch(cur, value)
+		default:
+			target[key] = value
+		}
+	}
+
+	return target
+}
+
+// decodeDocument parses a JSON or YAML document, chosen by file extension.
+func decodeDocument(filename string, content []byte) (map[string]interface{}, error) {
+	var document map[string]interface{}
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		var yamlDocument map[interface{}]interface{}
+
+		err := yaml.Unmarshal(content, &yamlDocument)
+		if err != nil {
+			return nil, fmt.Errorf("decode yaml %w", err)
+		}
+
+		document, _ = yamlToJSON(yamlDocument).(map[string]interface{})
+	default:
+		err := json.Unmarshal(content, &document)
+		if err != nil {
+			return nil, fmt.Errorf("decode json %w", err)
+		}
+	}
+
+	if document == nil {
+		document = map[string]interface{}{}
+	}
+
+	return document, nil
+}
+
+// yamlToJSON converts the generic maps decoded by yaml in the string keyed
+// maps used by encoding/json.
+func yamlToJSON(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(value))
+		for key, cur := range value {
+			out[fmt.Sprint(key)] = yamlToJSON(cur)
+		}
+
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(value))
+		for i, cur := range value {
+			out[i] = yamlToJSON(cur)
+		}
+
+		return out
+	default:
+		return value
+	}
+}
+
+func metadataFromDocument(document map[string]interface{}) (metadata ClientMetadata, err error) {
+	content, err := json.Marshal(document)
+	if err != nil {
+		return metadata, fmt.Errorf("client metadata %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+
+	err = decoder.Decode(&metadata)
+	if err != nil {
+		return metadata, fmt.Errorf("%w: %s", errInvalidMetadata, err)
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	// Examples of RFC 7396, appendix A
+	tests := []struct {
+		target string
+		patch  string
+		result string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`{"a":"foo"}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	decode := func(document string) map[string]interface{} {
+		var value map[string]interface{}
+
+		if err := json.Unmarshal([]byte(document), &value); err != nil {
+			t.Fatal(err)
+		}
+
+		return value
+	}
+
+	for _, test := range tests {
+		result := mergePatch(decode(test.target), decode(test.patch))
+		if !reflect.DeepEqual(result, decode(test.result)) {
+			t.Errorf("mergePatch(%s, %s) = %v, want %s", test.target, test.patch, result, test.result)
+		}
+	}
+}
+
+// writeFiles writes the named files in a temporary directory.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "iamclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestMergeClientOverlay(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"scope.yaml": "scope: openid storage.read:/\ngrant_types: [authorization_code, refresh_token]\n",
+		"uri.json":   `{"client_uri": null, "contacts": ["ops@example.org"]}`,
+		"jwks.yml":   "jwks:\n  keys:\n    - kty: EC\n      crv: P-256\n",
+		"typo.yaml":  "scopes: openid\n",
+		"bad.json":   `{"scope": `,
+	})
+
+	metadata := ClientMetadata{
+		ClientName: "client",
+		ClientURI:  "https://client.example",
+		Scope:      "openid profile",
+		GrantTypes: []string{GrantAuthorizationCode},
+	}
+
+	for _, name := range []string{"scope.yaml", "uri.json", "jwks.yml"} {
+		var err error
+
+		metadata, err = MergeClientOverlay(metadata, filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	want := ClientMetadata{
+		ClientName: "client",
+		Scope:      "openid storage.read:/",
+		GrantTypes: []string{GrantAuthorizationCode, GrantRefreshToken},
+		Contacts:   []string{"ops@example.org"},
+		Jwks:       json.RawMessage(`{"keys":[{"crv":"P-256","kty":"EC"}]}`),
+	}
+
+	if !reflect.DeepEqual(metadata, want) {
+		t.Errorf("merged metadata %+v, want %+v", metadata, want)
+	}
+
+	_, err := MergeClientOverlay(metadata, filepath.Join(dir, "typo.yaml"))
+	if !errors.Is(err, errInvalidMetadata) {
+		t.Errorf("overlay with an unknown field: error %v, want %v", err, errInvalidMetadata)
+	}
+
+	_, err = MergeClientOverlay(metadata, filepath.Join(dir, "bad.json"))
+	if err == nil {
+		t.Error("invalid overlay accepted")
+	}
+}
+
+func TestLoadClientTemplate(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"client.json": `{"client_name": {{ json .ClientName }}, "redirect_uris": [{{ json .CallbackURL }}]}`,
+		"client.yaml": "client_name: {{ .ClientName }}\nredirect_uris:\n  - {{ .CallbackURL }}\n",
+	})
+
+	config := IAMClientConfig{ClientName: `my "client"`, CallbackURL: "https://client.example/callback"}
+
+	for _, name := range []string{"client.json", "client.yaml"} {
+		if name == "client.yaml" {
+			config.ClientName = "my-client"
+		}
+
+		metadata, err := LoadClientTemplate(filepath.Join(dir, name), config)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if metadata.ClientName != config.ClientName || !reflect.DeepEqual(metadata.RedirectURIs, []string{config.CallbackURL}) {
+			t.Errorf("%s: rendered metadata %+v", name, metadata)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	errNoClientKey    = errors.New("no private key stored for the private_key_jwt client")
+	errNoRefreshToken = errors.New("no refresh token stored for the client, run login or device first, or register it with the service profile")
+	errTooManyArgs    = errors.New("too many arguments")
+)
+
+// TokenExpiryMargin is how long before its expiration a cached access token
+// is no longer handed out.
+var TokenExpiryMargin = time.Minute
+
+// TokenResponse is a successful response of the token endpoint (RFC 6749,
+// section 5.1).
+type TokenResponse struct {
+	AccessToken     string `json:"access_token"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in,omitempty"`
+	RefreshToken    string `json:"refresh_token,omitempty"`
+	IDToken         string `json:"id_token,omitempty"`
+	Scope           string `json:"scope,omitempty"`
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+}
+
+// clientAuthentication adds the client credentials to the form of a request
+// for the endpoint, with the token endpoint authentication method of the
+// client. It returns whether they must be sent with HTTP Basic instead.
+func clientAuthentication(form url.Values, clientResponse ClientResponse, audience string) (basic bool, err error) {
+	switch clientResponse.TokenEndpointAuthMethod {
+	case AuthNone:
+		form.Set("client_id", clientResponse.ClientID)
+	case AuthClientSecretPost:
+		form.Set("client_id", clientResponse.ClientID)
+		form.Set("client_secret", clientResponse.ClientSecret)
+	case AuthPrivateKeyJWT:
+		key, err := clientResponse.Key()
+		if err != nil {
+			return false, fmt.Errorf("client authentication %w", err)
+		}
+
+		if key == nil {
+			return false, errNoClientKey
+		}
+
+		assertion, err := ClientAssertion(clientResponse.ClientID, key, audience)
+		if err != nil {
+			return false, err
+		}
+
+		form.Set("client_id", clientResponse.ClientID)
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", assertion)
+	default:
+		// client_secret_basic, the default method (RFC 6749, section 2.3.1)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// postForm sends a form request, authenticated as the client, to an
+// endpoint of the provider and returns the status code and the body of the
+// response. The audience is the one of the private_key_jwt assertions.
+func (t *InitClientConfig) postForm(endpoint string, audience string, clientResponse ClientResponse, form url.Values) (status int, body []byte, err error) { //nolint:lll
+	basic, err := clientAuthentication(form, clientResponse, audience)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %s", errHTTP, err)
+	}
+
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(clientResponse.ClientID), url.QueryEscape(clientResponse.ClientSecret))
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	log.Debug().Str("URL", endpoint).Str("grant_type", form.Get("grant_type")).Msg("token")
+
+	resp, err := t.HTTPClient.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %s", errHTTP, err)
+	}
+
+	defer resp.Body.Close()
+
+	var buff bytes.Buffer
+
+	_, err = buff.ReadFrom(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("%w: %s", errHTTP, err)
+	}
+
+	log.Debug().Int("StatusCode", resp.StatusCode).Str("Status", resp.Status).Msg("token")
+
+	return resp.StatusCode, buff.Bytes(), nil
+}
+
+// TokenRequest sends a token request (RFC 6749, section 4) with the grant
+// parameters in form, authenticated as the client.
+func (t *InitClientConfig) TokenRequest(tokenEndpoint string, clientResponse ClientResponse, form url.Values) (token TokenResponse, err error) { //nolint:lll
+	status, body, err := t.postForm(tokenEndpoint, tokenEndpoint, clientResponse, form)
+	if err != nil {
+		return token, err
+	}
+
+	if status != http.StatusOK {
+		return token, tokenError(status, body)
+	}
+
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return token, fmt.Errorf("%w: invalid token response: %s", errHTTP, err)
+	}
+
+	if token.AccessToken == "" {
+		return token, fmt.Errorf("%w: no access_token in the token response", errHTTP)
+	}
+
+	return token, nil
+}
+
+// tokenExpiry returns when the access token of the response expires, from
+// its exp claim when it is a JWT, otherwise from expires_in. It is zero when
+// neither is known.
+func tokenExpiry(token TokenResponse) time.Time {
+	if _, claims, err := DecodeJWT(token.AccessToken); err == nil {
+		if exp, ok := claims["exp"].(json.Number); ok {
+			if value, err := exp.Int64(); err == nil {
+				return time.Unix(value, 0)
+			}
+		}
+	}
+
+	if token.ExpiresIn > 0 {
+		return time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+
+	return time.Time{}
+}
+
+// storeTokens saves the refresh token of the response with the client,
+// together with its access token, when any, until it expires.
+func (t *InitClientConfig) storeTokens(instance string, clientResponse ClientResponse, passwd *memguard.Enclave, token TokenResponse) (ClientResponse, error) { //nolint:lll
+	fields := map[string]interface{}{}
+
+	if expiry := tokenExpiry(token); token.AccessToken != "" && !expiry.IsZero() {
+		fields["access_token"] = token.AccessToken
+		fields["access_token_expires_at"] = expiry.Unix()
+	}
+
+	if token.RefreshToken != "" {
+		fields["refresh_token"] = token.RefreshToken
+	}
+
+	if len(fields) == 0 {
+		return clientResponse, nil
+	}
+
+	return t.UpdateStoredClient(instance, clientResponse, passwd, fields)
+}
+
+// lockClient locks the client in the stores shared by concurrent runs, so
+// that a refresh token rotated by the server is not overwritten with the
+// one it replaced.
+func (t *InitClientConfig) lockClient(instance string) (unlock func(), err error) {
+	locker, ok := t.store().(clientLocker)
+	if !ok {
+		return func() {}, nil
+	}
+
+	return locker.Lock(instance)
+}
+
+// AccessToken returns an access token of the stored client: the cached one
+// while it is valid for more than TokenExpiryMargin, otherwise a new one
+// obtained with the stored refresh token (RFC 6749, section 6) or, for the
+// clients without a user, with the client credentials grant (RFC 6749,
+// section 4.4). Tokens requested for a scope or an audience are never cached.
+func (t *InitClientConfig) AccessToken(instance string, scope string, audience string) (string, error) {
+	unlock, err := t.lockClient(instance)
+	if err != nil {
+		return "", err
+	}
+
+	defer unlock()
+
+	clientResponse, passwd, err := t.LoadClient(instance)
+	if err != nil {
+		return "", err
+	}
+
+	return t.clientAccessToken(instance, clientResponse, passwd, scope, audience)
+}
+
+// clientAccessToken is AccessToken for a client already loaded with
+// LoadClient.
+func (t *InitClientConfig) clientAccessToken(instance string, clientResponse ClientResponse, passwd *memguard.Enclave, scope string, audience string) (string, error) { //nolint:lll
+	custom := scope != "" || audience != ""
+
+	if !custom && clientResponse.AccessToken != "" &&
+		time.Now().Add(TokenExpiryMargin).Before(time.Unix(clientResponse.AccessTokenExpiresAt, 0)) {
+		log.Debug().Int64("expires_at", clientResponse.AccessTokenExpiresAt).Msg("token - cached")
+
+		return clientResponse.AccessToken, nil
+	}
+
+	form := url.Values{}
+
+	switch {
+	case clientResponse.RefreshToken != "":
+		form.Set("grant_type", GrantRefreshToken)
+		form.Set("refresh_token", clientResponse.RefreshToken)
+	case contains(clientResponse.GrantTypes, GrantClientCredentials):
+		form.Set("grant_type", GrantClientCredentials)
+	default:
+		return "", errNoRefreshToken
+	}
+
+	if scope != "" {
+		form.Set("scope", scope)
+	}
+
+	if audience != "" {
+		form.Set("audience", audience)
+	}
+
+	provider, err := t.Discover(clientResponse.IssuerEndpoint())
+	if err != nil {
+		return "", err
+	}
+
+	tokenEndpoint, err := requireEndpoint("token_endpoint", provider.TokenEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := t.TokenRequest(tokenEndpoint, clientResponse, form)
+	if err != nil {
+		return "", fmt.Errorf("%s %w", form.Get("grant_type"), err)
+	}
+
+	accessToken := token.AccessToken
+	if custom {
+		token.AccessToken = ""
+	}
+
+	// The server may rotate the refresh token on every use
+	_, err = t.storeTokens(instance, clientResponse, passwd, token)
+
+	switch {
+	case errors.Is(err, errStoreConflict):
+		// Another run refreshed the client in the meantime, the stored
+		// tokens are the newest ones
+		log.Warn().Err(err).Msg("token - tokens not stored")
+	case err != nil:
+		return "", err
+	}
+
+	return accessToken, nil
+}
+
+// tokenArgument returns the token given on the command line, or read from
+// the standard input when it is not given or is "-".
+func tokenArgument(args []string) (string, error) {
+	if len(args) > 1 {
+		return "", fmt.Errorf("%w: %s", errTooManyArgs, strings.Join(args[1:], " "))
+	}
+
+	if len(args) == 1 && args[0] != "-" {
+		return args[0], nil
+	}
+
+	content, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("read token %w", err)
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+func tokenOperation(clientIAM *InitClientConfig, instance string, args []string) error {
+	var output tokenOutput
+
+	flags := flag.NewFlagSet("token", flag.ContinueOnError)
+	scope := flags.String("scope", "", "scopes of the token, space separated")
+	audience := flags.String("audience", "", "audience of the token")
+	output.register(flags)
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() > 0 {
+		return fmt.Errorf("%w: %s", errTooManyArgs, strings.Join(flags.Args(), " "))
+	}
+
+	accessToken, err := clientIAM.AccessToken(instance, *scope, *audience)
+	if err != nil {
+		return err
+	}
+
+	written, err := output.write(accessToken)
+	if err != nil {
+		return err
+	}
+
+	if !written {
+		fmt.Println(accessToken)
+	}
+
+	return nil
+}
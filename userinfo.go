@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gookit/color"
+	"github.com/rs/zerolog/log"
+)
+
+// groupClaims are the claims carrying the groups and the entitlements of
+// the user, shown together.
+var groupClaims = []string{
+	"groups",
+	"wlcg.groups",
+	"eduperson_entitlement",
+	"eduPersonEntitlement",
+}
+
+// UserInfo returns the claims of the user returned by the userinfo
+// endpoint (OpenID Connect Core, section 5.3) of the provider of the stored
+// client, for the access token or for the one of the client when empty.
+func (t *InitClientConfig) UserInfo(instance string, accessToken string) (map[string]interface{}, error) {
+	if accessToken == "" {
+		unlock, err := t.lockClient(instance)
+		if err != nil {
+			return nil, err
+		}
+
+		defer unlock()
+	}
+
+	clientResponse, passwd, err := t.LoadClient(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	if accessToken == "" {
+		accessToken, err = t.clientAccessToken(instance, clientResponse, passwd, "", "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	provider, err := t.Discover(clientResponse.IssuerEndpoint())
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := requireEndpoint("userinfo_endpoint", provider.UserinfoEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().Str("URL", endpoint).Msg("userinfo")
+
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errHTTP, err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json, application/jwt")
+
+	resp, err := t.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errHTTP, err)
+	}
+
+	defer resp.Body.Close()
+
+	var buff bytes.Buffer
+
+	_, err = buff.ReadFrom(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errHTTP, err)
+	}
+
+	log.Debug().Int("StatusCode", resp.StatusCode).Str("Status", resp.Status).Msg("userinfo")
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo %w", bearerError(resp.StatusCode, resp.Header.Get("WWW-Authenticate"), buff.Bytes()))
+	}
+
+	// Signed responses are returned as a JWT (OpenID Connect Core, section 5.3.2)
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/jwt" {
+		_, claims, err := DecodeJWT(strings.TrimSpace(buff.String()))
+		if err != nil {
+			return nil, fmt.Errorf("userinfo %w", err)
+		}
+
+		return claims, nil
+	}
+
+	var claims map[string]interface{}
+
+	decoder := json.NewDecoder(&buff)
+	decoder.UseNumber()
+
+	err = decoder.Decode(&claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid userinfo response: %s", errHTTP, err)
+	}
+
+	return claims, nil
+}
+
+// printUserInfo shows the identity and the groups of the user first, then
+// the other claims.
+func printUserInfo(claims map[string]interface{}) {
+	shown := map[string]bool{}
+
+	for _, field := range []struct {
+		claim string
+		label string
+	}{
+		{"sub", "Subject"},
+		{"preferred_username", "Username"},
+		{"name", "Name"},
+		{"email", "Email"},
+	} {
+		if value, ok := claims[field.claim]; ok {
+			fmt.Printf("%-10s %v\n", field.label+":", value)
+
+			shown[field.claim] = true
+		}
+	}
+
+	for _, claim := range groupClaims {
+		values, ok := claims[claim].([]interface{})
+		if !ok {
+			continue
+		}
+
+		color.Green.Printf("==> %s:\n", claim)
+
+		for _, value := range values {
+			fmt.Printf("  %v\n", value)
+		}
+
+		shown[claim] = true
+	}
+
+	var others []string
+
+	for claim := range claims {
+		if !shown[claim] {
+			others = append(others, claim)
+		}
+	}
+
+	if len(others) == 0 {
+		return
+	}
+
+	sort.Strings(others)
+
+	color.Green.Println("==> Other claims:")
+
+	for _, claim := range others {
+		value, _ := json.Marshal(claims[claim])
+		fmt.Printf("  %s: %s\n", claim, value)
+	}
+}
+
+func userinfoOperation(clientIAM *InitClientConfig, instance string, args []string) error {
+	flags := flag.NewFlagSet("userinfo", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the claims as JSON")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	// The access token of the client is used when none is given
+	accessToken := ""
+
+	if flags.NArg() > 0 {
+		accessToken, err = tokenArgument(flags.Args())
+		if err != nil {
+			return err
+		}
+	}
+
+	claims, err := clientIAM.UserInfo(instance, accessToken)
+	if err != nil {
+		return err
+	}
+
+	if !*asJSON {
+		printUserInfo(claims)
+
+		return nil
+	}
+
+	out, err := json.MarshalIndent(claims, "", "  ")
+	if err != nil {
+		return fmt.Errorf("userinfo %w", err)
+	}
+
+	fmt.Println(string(out))
+
+	return nil
+}
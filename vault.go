@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	errNoVaultAddress = errors.New("no Vault address, please set env VAULT_ADDR")
+)
+
+// VaultStore keeps the clients as secrets of a HashiCorp Vault KV version 2
+// secrets engine, at <Mount>/<Path>/<instance>. A loaded client is saved
+// with check-and-set, failing if another run wrote it in the meantime.
+type VaultStore struct {
+	Address    string
+	Token      string
+	Namespace  string
+	Mount      string
+	Path       string
+	HTTPClient *http.Client
+
+	// versions are the secret versions loaded, by instance
+	versions map[string]int
+}
+
+// NewVaultStore configures a VaultStore with VAULT_ADDR, VAULT_TOKEN (or
+// VAULT_TOKEN_FILE), VAULT_NAMESPACE, VAULT_KV_MOUNT (secret by default) and
+// VAULT_KV_PATH (dodas-IAMClientRec by default). The server certificate is
+// verified as set by VAULT_CACERT and VAULT_SKIP_VERIFY.
+func NewVaultStore() (*VaultStore, error) {
+	token, err := envOrFile("VAULT_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+
+	store := &VaultStore{
+		Address:   strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/"),
+		Token:     token,
+		Namespace: os.Getenv("VAULT_NAMESPACE"),
+		Mount:     os.Getenv("VAULT_KV_MOUNT"),
+		Path:      os.Getenv("VAULT_KV_PATH"),
+	}
+
+	if store.Address == "" {
+		return nil, errNoVaultAddress
+	}
+
+	store.HTTPClient, err = tlsHTTPClient("VAULT")
+	if err != nil {
+		return nil, err
+	}
+
+	if store.Mount == "" {
+		store.Mount = "secret"
+	}
+
+	if store.Path == "" {
+		store.Path = "dodas-IAMClientRec"
+	}
+
+	return store, nil
+}
+
+func (s *VaultStore) url(kind string, instance string) string {
+	return fmt.Sprintf("%s/v1/%s/%s/%s/%s", s.Address, strings.Trim(s.Mount, "/"), kind, strings.Trim(s.Path, "/"), instance)
+}
+
+func (s *VaultStore) request(method string, url string, body []byte) (status int, rbody []byte, err error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, fmt.Errorf("vault %w", err)
+	}
+
+	req.Header.Set("X-Vault-Token", s.Token)
+	req.Header.Set("X-Vault-Request", "true")
+
+	if s.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.Namespace)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return storeRequest(s.HTTPClient, req)
+}
+
+// vaultError reports the errors of a Vault API response.
+func vaultError(status int, body []byte) error {
+	var vaultErr struct {
+		Errors []string `json:"errors"`
+	}
+
+	if json.Unmarshal(body, &vaultErr) == nil && len(vaultErr.Errors) > 0 {
+		return fmt.Errorf("%w: vault %d %s: %s", errHTTP, status, http.StatusText(status), strings.Join(vaultErr.Errors, ", "))
+	}
+
+	return fmt.Errorf("%w: vault %d %s", errHTTP, status, http.StatusText(status))
+}
+
+// Load reads the latest version of the client secret.
+func (s *VaultStore) Load(instance string) ([]byte, error) {
+	status, body, err := s.request(http.MethodGet, s.url("data", instance), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		delete(s.versions, instance)
+
+		return nil, fmt.Errorf("%w: %s", errClientNotStored, s.Location(instance))
+	default:
+		return nil, vaultError(status, body)
+	}
+
+	var secret struct {
+		Data struct {
+			Data     json.RawMessage `json:"data"`
+			Metadata struct {
+				Version int `json:"version"`
+			} `json:"metadata"`
+		} `json:"data"`
+	}
+
+	err = json.Unmarshal(body, &secret)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid vault response: %s", errHTTP, err)
+	}
+
+	s.setVersion(instance, secret.Data.Metadata.Version)
+
+	return secret.Data.Data, nil
+}
+
+func (s *VaultStore) setVersion(instance string, version int) {
+	if s.versions == nil {
+		s.versions = map[string]int{}
+	}
+
+	s.versions[instance] = version
+}
+
+// Save writes a new version of the client secret, with the fields of the
+// client as the secret keys. When the client was loaded, the write is
+// checked against the loaded version.
+func (s *VaultStore) Save(instance string, body []byte) error {
+	secret := map[string]interface{}{
+		"data": json.RawMessage(body),
+	}
+
+	version, loaded := s.versions[instance]
+	if loaded {
+		secret["options"] = map[string]int{"cas": version}
+	}
+
+	request, err := json.Marshal(secret)
+	if err != nil {
+		return fmt.Errorf("vault %w", err)
+	}
+
+	status, rbody, err := s.request(http.MethodPost, s.url("data", instance), request)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case status == http.StatusOK || status == http.StatusNoContent:
+	case loaded && status == http.StatusBadRequest && strings.Contains(string(rbody), "check-and-set"):
+		return fmt.Errorf("%w: %s", errStoreConflict, s.Location(instance))
+	default:
+		return vaultError(status, rbody)
+	}
+
+	var written struct {
+		Data struct {
+			Version int `json:"version"`
+		} `json:"data"`
+	}
+
+	if json.Unmarshal(rbody, &written) == nil && written.Data.Version > 0 {
+		s.setVersion(instance, written.Data.Version)
+	} else {
+		delete(s.versions, instance)
+	}
+
+	return nil
+}
+
+// Delete removes the client secret with all its versions.
+func (s *VaultStore) Delete(instance string) error {
+	status, body, err := s.request(http.MethodDelete, s.url("metadata", instance), nil)
+	if err != nil {
+		return err
+	}
+
+	if status != http.StatusOK && status != http.StatusNoContent {
+		return vaultError(status, body)
+	}
+
+	delete(s.versions, instance)
+
+	return nil
+}
+
+// Exists tells whether the client secret has a current version.
+func (s *VaultStore) Exists(instance string) (bool, error) {
+	_, err := s.Load(instance)
+
+	switch {
+	case errors.Is(err, errClientNotStored):
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return true, nil
+	}
+}
+
+// Encrypted is false, Vault encrypts the secrets itself.
+func (s *VaultStore) Encrypted() bool {
+	return false
+}
+
+// Location is the path of the client secret.
+func (s *VaultStore) Location(instance string) string {
+	return fmt.Sprintf("vault %s/%s/%s", strings.Trim(s.Mount, "/"), strings.Trim(s.Path, "/"), instance)
+}